@@ -0,0 +1,31 @@
+package goticles
+
+// The Base type holds what Space implementations have in common: gravity,
+// fields, the particles and the time. Embedded in a Space, it provides all
+// methods of Space but Step, which advances the time with Advance.
+type Base struct {
+	Gravity
+	Index
+	Fields Fields // applied on top of gravity
+	time   float64
+}
+
+// NewBase returns a Base with default gravity and no particles.
+func NewBase() Base {
+	return Base{Gravity: NewGravity()}
+}
+
+// Time returns the current simulation time.
+func (b *Base) Time() float64 {
+	return b.time
+}
+
+// SetTime sets the current simulation time to t.
+func (b *Base) SetTime(t float64) {
+	b.time = t
+}
+
+// Advance advances the simulation time by dt.
+func (b *Base) Advance(dt float64) {
+	b.time += dt
+}
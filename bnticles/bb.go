@@ -3,6 +3,7 @@ package bnticles
 import (
 	"fmt"
 	"github.com/niksaak/goticles/vect"
+	"math"
 )
 
 type BadSideIdError Side
@@ -78,6 +79,16 @@ func (b BB) Size() float64 {
 	return b[1].X - b[0].X
 }
 
+// corners returns the four corners of b.
+func (b BB) corners() [4]vect.V {
+	return [4]vect.V{b[0], {b[1].X, b[0].Y}, b[1], {b[0].X, b[1].Y}}
+}
+
+// grow returns b enlarged by d on each side.
+func (b BB) grow(d float64) BB {
+	return BB{{b[0].X - d, b[0].Y + d}, {b[1].X + d, b[1].Y - d}}
+}
+
 func (b BB) Query(v vect.V) bool {
 	return v.X >= b[0].X && v.Y <= b[0].Y &&
 		v.X < b[1].X && v.Y > b[1].Y
@@ -110,3 +121,48 @@ func (b BB) Side(side Side) BB {
 		panic(BadSideIdError(side))
 	}
 }
+
+// BB_MARGIN is the relative margin by which bounds enlarges the box, so that
+// particles on its eastern and southern edges are still inside.
+const BB_MARGIN = 1e-9
+
+// bounds returns a square BB slightly larger than the extent of particles, so
+// that Query holds for each of them. Empty or pointlike sets get a box of
+// size 2. It panics if the extent is not finite, as with NaN or infinite
+// positions.
+func bounds(particles []particle) BB {
+	if len(particles) == 0 {
+		return BB{{-1, 1}, {1, -1}}
+	}
+	min, max := particles[0].position, particles[0].position
+	for i := range particles[1:] {
+		v := particles[i+1].position
+		min.X, min.Y = math.Min(min.X, v.X), math.Min(min.Y, v.Y)
+		max.X, max.Y = math.Max(max.X, v.X), math.Max(max.Y, v.Y)
+	}
+	center := min.Add(max).Div(2)
+	half := 0.5 * math.Max(max.X-min.X, max.Y-min.Y) * (1 + BB_MARGIN)
+	if !finite(center.X) || !finite(center.Y) || !finite(half) {
+		panic(fmt.Errorf("bounds: bad extent of particles - %v to %v",
+			min, max))
+	}
+	if half == 0 {
+		half = 1
+	}
+	for {
+		b := BB{
+			{center.X - half, center.Y + half},
+			{center.X + half, center.Y - half},
+		}
+		// margin may be lost in rounding far from the origin
+		if b.Query(vect.V{min.X, max.Y}) && b.Query(vect.V{max.X, min.Y}) {
+			return b
+		}
+		half *= 2
+	}
+}
+
+// finite returns whether x is neither infinite nor NaN.
+func finite(x float64) bool {
+	return !math.IsInf(x, 0) && !math.IsNaN(x)
+}
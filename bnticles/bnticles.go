@@ -1,89 +1,211 @@
 package bnticles
 
 import (
-	//"fmt"
+	"fmt"
 	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/units"
 	"github.com/niksaak/goticles/vect"
 )
 
-type Space struct {
-	time        float64
-	Particles   []goticles.P
-	bnParticles [4][]particle
-}
+// The Method type selects how a Space integrates accelerations computed from
+// the tree.
+type Method int
 
-func New() *Space {
-	return new(Space)
-}
+const (
+	// RK4 is the classic fourth order Runge-Kutta method, building the tree
+	// four times per step.
+	RK4 Method = iota
+	// Leapfrog is the kick-drift-kick leapfrog, building the tree once per
+	// step. It reuses gravity computed at the end of the previous step unless
+	// particles or gravity have changed since, while external forces and
+	// fields are applied afresh at every kick.
+	Leapfrog
+)
 
-func (s *Space) Particle(id int) *goticles.P {
-	if id >= len(s.Particles) {
-		return nil
+func (m Method) String() string {
+	switch m {
+	case RK4:
+		return "RK4"
+	case Leapfrog:
+		return "Leapfrog"
+	default:
+		return fmt.Sprintf("Method(%d)", int(m))
 	}
-	return &s.Particles[id]
 }
 
-func (s *Space) MkParticle(mass float64) *goticles.P {
-	id := len(s.Particles)
-	s.Particles = append(s.Particles, goticles.P{
-		Id:   id,
-		Mass: mass,
-	})
-	for i := range s.bnParticles {
-		s.bnParticles[i] = append(s.bnParticles[i], particle{})
-	}
-	return &s.Particles[id]
+type Space struct {
+	units.Base
+	Method      Method
+	Criterion   Criterion // opening criterion of the tree walk
+	Theta       float64   // opening angle of the tree walk
+	Tolerance   float64   // acceleration error of the Relative criterion
+	Order       Order     // multipole order of nodes
+	LeafSize    int       // particles in a leaf before it is split
+	MaxDepth    int       // depth below which leaves are not split
+	Workers     int       // goroutines building and walking the tree
+	Refit       int       // steps between tree rebuilds, 0 to never refit
+	bnParticles [4][]particle
+	tree        tree
+	walkFunc    func(lo, hi int) // cached to keep steps free of allocations
+	walkStage   int
+	built       bool // whether the tree holds current particles
+	sinceBuild  int  // steps since the tree was built
+	stage       []goticles.P
+	fieldAccel  []vect.V
+	gravities   []vect.V
+	accelerated bool              // whether Leapfrog gravities are up to date
+	snapshot    goticles.Snapshot // particles at the end of the last step
 }
 
-func (s *Space) RmParticle(p *goticles.P) {
-	// TODO
+var _ units.Space = &Space{}
+
+func New() *Space {
+	return &Space{
+		Base:      units.NewBase(),
+		Theta:     THETA,
+		Tolerance: TOLERANCE,
+		LeafSize:  LEAF_SIZE,
+		MaxDepth:  MAX_DEPTH,
+	}
 }
 
 func (s *Space) Step(dt float64) {
-	s.time += dt
-	s.evaluate1()
-	s.evaluateK(dt/2, 1)
-	s.evaluateK(dt/2, 2)
-	s.evaluateK(dt, 3)
-	s.applyState()
+	if !s.snapshot.Holds(&s.Gravity, s.Particles) {
+		// particles were changed from outside, or even made and removed
+		s.accelerated = false
+		s.built = false
+	}
+	switch s.Method {
+	case RK4:
+		s.evaluate1()
+		s.evaluateK(dt/2, 1)
+		s.evaluateK(dt/2, 2)
+		s.evaluateK(dt, 3)
+		s.applyState(dt)
+	case Leapfrog:
+		s.accelerate()
+		s.kick(dt / 2)
+		s.drift(dt)
+		s.accelerate()
+		s.kick(dt / 2)
+	default:
+		panic(fmt.Errorf("Step: bad method - %v", s.Method))
+	}
+	s.snapshot.Take(&s.Gravity, s.Particles)
+	s.Advance(dt)
+	s.sinceBuild++
 }
 
 func (s *Space) evaluate1() {
+	s.load()
+	s.accelerateStage(0)
+}
+
+// load sets the state of stage 0 to that of the particles, first sizing
+// stages for them.
+func (s *Space) load() {
+	if len(s.bnParticles[0]) != len(s.Particles) {
+		for k := range s.bnParticles {
+			s.bnParticles[k] = make([]particle, len(s.Particles))
+		}
+	}
 	for i, p := range s.Particles {
 		s.bnParticles[0][i] = particle{
-			position: p.Position,
-			velocity: p.Velocity,
-			mass:     p.Mass,
+			position:     p.Position,
+			velocity:     p.Velocity,
+			acceleration: p.Acceleration,
+			mass:         p.Mass,
 		}
 	}
 }
 
+// evaluateK computes the state of stage k, advanced by dt from the initial
+// state with the derivatives of stage k-1.
 func (s *Space) evaluateK(dt float64, k int) {
-	q := NewQuad(BB{{-1, 1}, {1, -1}})
-	copy(s.bnParticles[k], s.bnParticles[0])
-	q.insertSlice(s.bnParticles[k])
 	for i := range s.bnParticles[k] {
+		p0, prev := &s.bnParticles[0][i], &s.bnParticles[k-1][i]
+		s.bnParticles[k][i] = particle{
+			position:     p0.position.Add(prev.velocity.Mul(dt)),
+			velocity:     p0.velocity.Add(prev.acceleration.Mul(dt)),
+			acceleration: prev.acceleration,
+			mass:         p0.mass,
+		}
+	}
+	s.accelerateStage(k)
+}
+
+// accelerateStage computes the accelerations of particles in stage k.
+func (s *Space) accelerateStage(k int) {
+	s.gravitate(k)
+	s.accelerateExternal(k)
+}
+
+// gravitate computes the gravity of particles in stage k. Workers walk the
+// tree for particles in tree order, so each of them gets particles close in
+// space.
+func (s *Space) gravitate(k int) {
+	s.updateTree(s.bnParticles[k])
+	if s.walkFunc == nil {
+		s.walkFunc = s.walk
+	}
+	s.walkStage = k
+	goticles.Parallel(s.Workers, len(s.Particles), s.walkFunc)
+}
+
+// walk computes tree accelerations of particles of the current stage, from lo
+// to hi in tree order.
+func (s *Space) walk(lo, hi int) {
+	particles := s.bnParticles[s.walkStage]
+	for _, i := range s.tree.order[lo:hi] {
+		p := &particles[i]
+		p.acceleration = s.treeAccel(p, &s.tree, 0)
+	}
+}
+
+// accelerateExternal adds the acceleration due to external forces and
+// s.Fields at stage k.
+func (s *Space) accelerateExternal(k int) {
+	for i := range s.Particles {
+		p := &s.bnParticles[k][i]
+		p.acceleration = p.acceleration.Add(
+			s.Particles[i].ExternalAcceleration())
+	}
+	if len(s.Fields) == 0 {
+		return
+	}
+	if len(s.stage) != len(s.Particles) {
+		s.stage = make([]goticles.P, len(s.Particles))
+		s.fieldAccel = make([]vect.V, len(s.Particles))
+	}
+	for i := range s.stage {
+		s.stage[i] = s.Particles[i]
+		s.stage[i].Position = s.bnParticles[k][i].position
+		s.stage[i].Velocity = s.bnParticles[k][i].velocity
+		s.fieldAccel[i] = vect.V{}
+	}
+	s.Fields.Accelerate(s.stage, s.fieldAccel)
+	for i := range s.stage {
 		p := &s.bnParticles[k][i]
-		p.position = p.position.Add(s.bnParticles[k-1][i].velocity.Mul(dt))
-		p.velocity = p.velocity.Sub(p.treeForce(q))
-		p.mass = s.bnParticles[k-1][i].mass
+		p.acceleration = p.acceleration.Add(s.fieldAccel[i])
 	}
 }
 
-func (s *Space) applyState() {
+func (s *Space) applyState(dt float64) {
 	for i := range s.Particles {
 		p := &s.Particles[i]
-		p.Position = rk4mean(
-			s.bnParticles[0][i].position,
-			s.bnParticles[1][i].position,
-			s.bnParticles[2][i].position,
-			s.bnParticles[3][i].position)
-		p.Velocity = rk4mean(
+		p.Position = p.Position.Add(rk4mean(
 			s.bnParticles[0][i].velocity,
 			s.bnParticles[1][i].velocity,
 			s.bnParticles[2][i].velocity,
-			s.bnParticles[3][i].velocity)
+			s.bnParticles[3][i].velocity).Mul(dt))
+		p.Velocity = p.Velocity.Add(rk4mean(
+			s.bnParticles[0][i].acceleration,
+			s.bnParticles[1][i].acceleration,
+			s.bnParticles[2][i].acceleration,
+			s.bnParticles[3][i].acceleration).Mul(dt))
+		p.Acceleration = s.bnParticles[0][i].acceleration
 	}
+	s.accelerated = false
 }
 
 func rk4mean(k1, k2, k3, k4 vect.V) vect.V {
@@ -92,3 +214,45 @@ func rk4mean(k1, k2, k3, k4 vect.V) vect.V {
 		Y: (1.0 / 6.0) * (k1.Y + 2*(k2.Y+k3.Y) + k4.Y),
 	}
 }
+
+// accelerate computes the total accelerations of particles in their current
+// state, storing them in their Acceleration. Gravity is only computed if it is
+// not up to date, while external forces and fields, which may have changed,
+// always are.
+func (s *Space) accelerate() {
+	if len(s.gravities) != len(s.Particles) {
+		s.gravities = make([]vect.V, len(s.Particles))
+		s.accelerated = false
+	}
+	s.load()
+	if s.accelerated {
+		for i := range s.Particles {
+			s.bnParticles[0][i].acceleration = s.gravities[i]
+		}
+	} else {
+		s.gravitate(0)
+		for i := range s.Particles {
+			s.gravities[i] = s.bnParticles[0][i].acceleration
+		}
+		s.accelerated = true
+	}
+	s.accelerateExternal(0)
+	for i := range s.Particles {
+		s.Particles[i].Acceleration = s.bnParticles[0][i].acceleration
+	}
+}
+
+func (s *Space) kick(dt float64) {
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Velocity = p.Velocity.Add(p.Acceleration.Mul(dt))
+	}
+}
+
+func (s *Space) drift(dt float64) {
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Position = p.Position.Add(p.Velocity.Mul(dt))
+	}
+	s.accelerated = false
+}
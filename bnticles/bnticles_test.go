@@ -2,28 +2,37 @@ package bnticles
 
 import (
 	"fmt"
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/leapfrog"
+	"github.com/niksaak/goticles/rk4"
+	"github.com/niksaak/goticles/units"
 	"github.com/niksaak/goticles/vect"
+	"math"
 	"math/rand"
 	"testing"
 )
 
 const TREESTRING_INDENT = "  "
 
-func treeString(nd node, prefix string) (s string) {
+func treeString(t *tree, i int32, prefix string) (s string) {
+	c := &t.cells[i]
 	s = prefix
-	switch n := nd.(type) {
-	case *quad:
-		s += fmt.Sprintf("quad %v; COM: %v, m: %v\n", n.BB, n.position, n.mass)
-		for _, child := range n.children {
-			if child == nil {
-				s += prefix + TREESTRING_INDENT + "nil\n"
-			} else {
-				s += treeString(child, prefix+TREESTRING_INDENT)
-			}
+	if c.leaf {
+		s += fmt.Sprintf("leaf %v; COM: %v, m: %v\n", c.BB, c.position, c.mass)
+		for _, k := range t.order[c.first : c.first+c.count] {
+			p := &t.particles[k]
+			s += fmt.Sprintf("%sparticle @%v; ->%v; m: %v\n",
+				prefix+TREESTRING_INDENT, p.position, p.velocity, p.mass)
+		}
+		return s
+	}
+	s += fmt.Sprintf("cell %v; COM: %v, m: %v\n", c.BB, c.position, c.mass)
+	for _, child := range c.children {
+		if child == 0 {
+			s += prefix + TREESTRING_INDENT + "nil\n"
+		} else {
+			s += treeString(t, child, prefix+TREESTRING_INDENT)
 		}
-	case *particle:
-		s += fmt.Sprintf("particle @%v; ->%v; m: %v\n",
-			n.position, n.velocity, n.mass)
 	}
 	return s
 }
@@ -33,17 +42,15 @@ func rf64() float64 {
 	return rand.Float64() - 0.5
 }
 
-func spaceTree(s *Space) *quad {
+func spaceTree(s *Space) *tree {
 	s.evaluate1()
-	qtree := NewQuad(BB{{-1, 1}, {1, -1}})
-	qtree.insertSlice(s.bnParticles[0])
-	return qtree
+	return s.buildTree(s.bnParticles[0])
 }
 
 func makeSpace(count int, tb testing.TB) *Space {
 	space := New()
 	for i := 0; i < count; i++ {
-		p := space.MkParticle(1)
+		p := space.MkParticle(1).P()
 		p.Position = vect.V{rf64(), rf64()}
 	}
 	if result := len(space.Particles); count != result {
@@ -55,11 +62,125 @@ func makeSpace(count int, tb testing.TB) *Space {
 func TestQuadTreeBuilding(t *testing.T) {
 	const COUNT = 8
 	space := makeSpace(COUNT, t)
-	quad := spaceTree(space)
-	for _, p := range space.bnParticles[0] {
-		t.Logf("created %s", treeString(&p, ""))
+	tree := spaceTree(space)
+	t.Logf("\n%s", treeString(tree, 0, ""))
+}
+
+func TestTreeBounds(t *testing.T) {
+	const COUNT = 64
+	for _, c := range []struct{ scale, offset float64 }{
+		{1, 0}, {1e-6, 0}, {1e6, 0}, {1, 1e12}, {1e3, -1e3},
+	} {
+		space := New()
+		for i := 0; i < COUNT; i++ {
+			p := space.MkParticle(1).P()
+			p.Position = vect.V{rf64(), rf64()}.Mul(c.scale).Add(
+				vect.V{c.offset, c.offset})
+		}
+		space.Particles[0].Position = space.Particles[1].Position.Add(
+			vect.V{c.scale, 0})
+		count := checkTree(spaceTree(space), 0, LEAF_SIZE, MAX_DEPTH, 0, t)
+		if count != COUNT {
+			t.Errorf("scale %v, offset %v: tree holds %d particles, not %d",
+				c.scale, c.offset, count, COUNT)
+		}
+	}
+}
+
+func TestTreeBoundsNotFinite(t *testing.T) {
+	const MAX = math.MaxFloat64
+	for _, c := range []struct{ a, b vect.V }{
+		{vect.V{}, vect.V{math.NaN(), 0}},
+		{vect.V{}, vect.V{0, math.Inf(1)}},
+		{vect.V{math.Inf(-1), 0}, vect.V{}},
+		{vect.V{-MAX, 0}, vect.V{MAX, 0}}, // extent overflows
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("bounds of %v and %v did not panic", c.a, c.b)
+				}
+			}()
+			bounds([]particle{{position: c.a}, {position: c.b}})
+		}()
+	}
+	b := bounds([]particle{{position: vect.V{-MAX, 0}}, {}})
+	if !b.Query(vect.V{-MAX, 0}) || !b.Query(vect.V{}) {
+		t.Errorf("bounds %v miss particles", b)
+	}
+}
+
+// checkTree reports leaves of cell i in tr holding more than leafSize
+// particles above maxDepth, lying below it, or holding particles outside
+// their box, and returns the number of particles in them.
+func checkTree(tr *tree, i int32, leafSize, maxDepth, depth int,
+	t *testing.T) (count int) {
+	c := &tr.cells[i]
+	if !c.leaf {
+		for _, child := range c.children {
+			if child != 0 {
+				count += checkTree(tr, child, leafSize, maxDepth, depth+1, t)
+			}
+		}
+		return count
+	}
+	if depth > maxDepth {
+		t.Errorf("leaf at depth %d over %d", depth, maxDepth)
+	}
+	if int(c.count) > leafSize && depth < maxDepth {
+		t.Errorf("leaf at depth %d holds %d particles over %d",
+			depth, c.count, leafSize)
+	}
+	// allow for rounding of box edges far from the origin
+	center := c.Center()
+	ulp := 1e-15 * (math.Abs(center.X) + math.Abs(center.Y))
+	bb := BB{c.BB[0].Add(vect.V{-ulp, ulp}), c.BB[1].Add(vect.V{ulp, -ulp})}
+	for _, k := range tr.order[c.first : c.first+c.count] {
+		if p := tr.particles[k].position; !bb.Query(p) {
+			t.Errorf("leaf %v holds particle at %v", c.BB, p)
+		}
+	}
+	return int(c.count)
+}
+
+func TestTreeShape(t *testing.T) {
+	const COUNT = 256
+	for _, leafSize := range []int{1, 8, 64} {
+		for _, maxDepth := range []int{1, 3, MAX_DEPTH} {
+			space := makeSpace(COUNT, t)
+			space.LeafSize = leafSize
+			space.MaxDepth = maxDepth
+			tree := spaceTree(space)
+			count := checkTree(tree, 0, leafSize, maxDepth, 0, t)
+			if count != COUNT {
+				t.Errorf("tree holds %d particles, not %d", count, COUNT)
+			}
+		}
+	}
+}
+
+func TestCoincidentParticles(t *testing.T) {
+	const COUNT = 16
+	space := New()
+	for i := 0; i < COUNT; i++ {
+		p := space.MkParticle(1).P()
+		p.Position = vect.V{0.25, 0.25}
+	}
+	space.MkParticle(1).P().Position = vect.V{-0.5, -0.5}
+	tree := spaceTree(space)
+	if count := checkTree(tree, 0, LEAF_SIZE, MAX_DEPTH, 0, t); count != COUNT+1 {
+		t.Errorf("tree holds %d particles, not %d", count, COUNT+1)
+	}
+	space.Step(1.0 / 60)
+	first := space.Particles[0]
+	for _, p := range space.Particles[1:COUNT] {
+		if !p.Position.Eql(first.Position) || !p.Velocity.Eql(first.Velocity) {
+			t.Errorf("coincident particles diverged: %v and %v", first, p)
+		}
+	}
+	if first.Velocity.Eql(vect.V{}) {
+		t.Errorf("coincident particles are not attracted")
 	}
-	t.Logf("\n%s", treeString(quad, ""))
 }
 
 func logParticles(s *Space, tb testing.TB) {
@@ -90,12 +211,257 @@ func TestTwoBodyPositionChanges(t *testing.T) {
 	}
 }
 
+// configure softens gravity of s, and fills it with count particles of total
+// mass 1 placed reproducibly.
+func configure(s goticles.Space, count int) {
+	var g *goticles.Gravity
+	switch s := s.(type) {
+	case *Space:
+		g = &s.Gravity
+	case *rk4.Space:
+		g = &s.Gravity
+	case *leapfrog.Space:
+		g = &s.Gravity
+	}
+	g.Kernel = goticles.PlummerKernel
+	g.Softening = 0.05
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < count; i++ {
+		p := s.MkParticle(1.0 / float64(count)).P()
+		p.Position = vect.V{rnd.Float64() - 0.5, rnd.Float64() - 0.5}
+		p.Velocity = vect.V{rnd.Float64() - 0.5, rnd.Float64() - 0.5}.Div(4)
+	}
+}
+
+// maxDistance returns the largest distance between positions of particles
+// with the same id in spaces a and b.
+func maxDistance(a, b goticles.Space) (dist float64) {
+	for _, p := range a.All() {
+		dist = math.Max(dist, p.Position.Dst(b.Particle(p.Id).Position))
+	}
+	return dist
+}
+
+func TestConvergenceToDirectSum(t *testing.T) {
+	const COUNT = 64
+	const STEP = 1.0 / 100
+	references := map[Method]goticles.Space{
+		RK4:      rk4.New(),
+		Leapfrog: leapfrog.New(),
+	}
+	for method, reference := range references {
+		reference.(units.Space).SetUnits(units.NBody(1, 1))
+		configure(reference, COUNT)
+		for i := 0; i < 10; i++ {
+			reference.Step(STEP)
+		}
+		var errors []float64
+		for _, theta := range []float64{1, 0.5, 0.25, 0} {
+			space := New()
+			space.Method = method
+			space.Theta = theta
+			space.LeafSize = 1
+			space.SetUnits(units.NBody(1, 1))
+			configure(space, COUNT)
+			for i := 0; i < 10; i++ {
+				space.Step(STEP)
+			}
+			errors = append(errors, maxDistance(space, reference))
+		}
+		t.Logf("%v: errors for decreasing theta: %.3g", method, errors)
+		if last := errors[len(errors)-1]; last > 1e-12 {
+			t.Errorf("%v: error at zero theta is %v", method, last)
+		}
+		if errors[2] >= errors[0] {
+			t.Errorf("%v: error does not decrease with theta: %v",
+				method, errors)
+		}
+	}
+}
+
+// accelError returns the root mean square error of tree accelerations in s
+// relative to direct summation.
+func accelError(s *Space) float64 {
+	particles := s.bnParticles[0]
+	tree := s.buildTree(particles)
+	var sum float64
+	for i := range particles {
+		p := &particles[i]
+		var direct vect.V
+		for j := range particles {
+			if i != j {
+				direct = direct.Add(p.accel(&particles[j], &s.Gravity))
+			}
+		}
+		sum += s.treeAccel(p, tree, 0).DstSq(direct) / direct.LenSq()
+	}
+	return math.Sqrt(sum / float64(len(particles)))
+}
+
+func TestMultipoleOrder(t *testing.T) {
+	const COUNT = 512
+	for _, law := range []goticles.ForceLaw{
+		goticles.Newtonian, goticles.Logarithmic, goticles.PowerLaw,
+	} {
+		for _, theta := range []float64{0.5, 0.3} {
+			var errors [2]float64
+			for _, order := range []Order{Monopole, Quadrupole} {
+				space := New()
+				space.SetUnits(units.NBody(1, 1))
+				space.Law = law
+				space.Exponent = 3
+				space.Theta = theta
+				space.Order = order
+				configure(space, COUNT)
+				space.evaluate1()
+				errors[order] = accelError(space)
+			}
+			t.Logf("%v, theta %v: monopole error %.3g, quadrupole error %.3g",
+				law, theta, errors[Monopole], errors[Quadrupole])
+			if errors[Quadrupole] > errors[Monopole]/2 {
+				t.Errorf("%v, theta %v: quadrupole error %v is not "+
+					"well below monopole error %v", law, theta,
+					errors[Quadrupole], errors[Monopole])
+			}
+		}
+	}
+}
+
+func TestCriteria(t *testing.T) {
+	const COUNT = 512
+	criteriaError := func(criterion Criterion, theta, tolerance float64) float64 {
+		space := New()
+		space.SetUnits(units.NBody(1, 1))
+		space.Criterion = criterion
+		space.Theta = theta
+		space.Tolerance = tolerance
+		configure(space, COUNT)
+		space.evaluate1()
+		return accelError(space)
+	}
+	for _, criterion := range []Criterion{BarnesHut, BMax} {
+		loose := criteriaError(criterion, 0.8, 0)
+		tight := criteriaError(criterion, 0.4, 0)
+		t.Logf("%v: errors %.3g and %.3g", criterion, loose, tight)
+		if tight > loose/2 {
+			t.Errorf("%v: error %v at smaller theta is not well below %v",
+				criterion, tight, loose)
+		}
+	}
+	for _, tolerance := range []float64{0.02, 0.002} {
+		err := criteriaError(Relative, THETA, tolerance)
+		t.Logf("%v: error %.3g at tolerance %v", Relative, err, tolerance)
+		if err > tolerance {
+			t.Errorf("%v: error %v over tolerance %v",
+				Relative, err, tolerance)
+		}
+	}
+}
+
+func TestStepAllocations(t *testing.T) {
+	const COUNT = 256
+	for _, method := range []Method{RK4, Leapfrog} {
+		space := makeSpace(COUNT, t)
+		space.Method = method
+		space.Workers = 1 // goroutines allocate
+		space.Step(1.0 / 60)
+		allocs := testing.AllocsPerRun(10, func() {
+			space.Step(1.0 / 60)
+		})
+		if allocs != 0 {
+			t.Errorf("%v: step allocates %v times", method, allocs)
+		}
+	}
+}
+
+func TestWorkers(t *testing.T) {
+	const COUNT = 4096
+	const STEP = 1.0 / 100
+	run := func(workers int) *Space {
+		space := New()
+		space.SetUnits(units.NBody(1, 1))
+		space.Order = Quadrupole
+		space.Workers = workers
+		configure(space, COUNT)
+		for i := 0; i < 3; i++ {
+			space.Step(STEP)
+		}
+		return space
+	}
+	reference := run(1)
+	for _, workers := range []int{2, 3, 8} {
+		space := run(workers)
+		for i, p := range space.Particles {
+			q := reference.Particles[i]
+			if !p.Position.Eql(q.Position) || !p.Velocity.Eql(q.Velocity) {
+				t.Errorf("%d workers: particle %d is %v, not %v",
+					workers, i, p, q)
+				break
+			}
+		}
+	}
+}
+
+func TestRefit(t *testing.T) {
+	const COUNT = 256
+	space := New()
+	configure(space, COUNT)
+	space.evaluate1()
+	particles := make([]particle, COUNT)
+	copy(particles, space.bnParticles[0])
+	for i := range particles {
+		particles[i].position = particles[i].position.Add(
+			vect.V{1e-9, -1e-9})
+	}
+	if !space.tree.refit(particles) {
+		t.Fatalf("tree is not refit to slightly moved particles")
+	}
+	refit := space.tree.cells[0]
+	built := space.buildTree(particles).cells[0]
+	if d := refit.position.Dst(built.position); d > 1e-15 {
+		t.Errorf("refit center of mass is off by %v", d)
+	}
+	if d := refit.mass - built.mass; math.Abs(d) > 1e-15 {
+		t.Errorf("refit mass is off by %v", d)
+	}
+	particles[0].position = particles[0].position.Mul(-1)
+	if space.tree.refit(particles) {
+		t.Errorf("tree is refit to a particle out of its leaf")
+	}
+}
+
+func TestRefitIntegration(t *testing.T) {
+	const COUNT = 256
+	const STEP = 1.0 / 100
+	run := func(space goticles.Space) goticles.Space {
+		space.(units.Space).SetUnits(units.NBody(1, 1))
+		configure(space, COUNT)
+		for i := 0; i < 20; i++ {
+			space.Step(STEP)
+		}
+		return space
+	}
+	reference := run(rk4.New())
+	rebuilt := maxDistance(run(New()), reference)
+	for _, refit := range []int{1, 5, 20} {
+		space := New()
+		space.Refit = refit
+		err := maxDistance(run(space), reference)
+		t.Logf("refit every %d steps: error %.3g, rebuilt %.3g",
+			refit, err, rebuilt)
+		if err > 2*rebuilt {
+			t.Errorf("refit every %d steps: error %v is well over %v",
+				refit, err, rebuilt)
+		}
+	}
+}
+
 func BenchmarkQuadTreeBuilding(b *testing.B) {
 	const COUNT = 1024
 	space := New()
 	// do some dirty deeds to purify the bench results
 	for i := 0; i < COUNT; i++ {
-		p := space.MkParticle(1)
+		p := space.MkParticle(1).P()
 		p.Position = vect.V{rf64(), rf64()}
 	}
 	space.evaluate1()
@@ -103,8 +469,7 @@ func BenchmarkQuadTreeBuilding(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		quad := NewQuad(BB{{-1, 1}, {1, -1}})
-		quad.insertSlice(particles)
+		space.buildTree(particles)
 	}
 }
 
@@ -118,3 +483,41 @@ func BenchmarkBarnesHutSimulation(b *testing.B) {
 	}
 	b.Logf("%v", space.Particle(0).Position)
 }
+
+func BenchmarkWorkers(b *testing.B) {
+	const STEP = 1.0 / 100
+	for _, count := range []int{16384, 65536} {
+		for _, workers := range []int{1, 2, 4, 8} {
+			name := fmt.Sprintf("%d/%d", count, workers)
+			b.Run(name, func(b *testing.B) {
+				space := New()
+				space.SetUnits(units.NBody(1, 1))
+				space.Method = Leapfrog
+				space.Workers = workers
+				configure(space, count)
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					space.Step(STEP)
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkRefit(b *testing.B) {
+	const COUNT = 16384
+	const STEP = 1.0 / 100
+	for _, refit := range []int{0, 1, 10} {
+		b.Run(fmt.Sprint(refit), func(b *testing.B) {
+			space := New()
+			space.SetUnits(units.NBody(1, 1))
+			space.Refit = refit
+			space.Workers = 1
+			configure(space, COUNT)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				space.Step(STEP)
+			}
+		})
+	}
+}
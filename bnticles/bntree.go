@@ -2,111 +2,345 @@ package bnticles
 
 import (
 	"fmt"
+	"github.com/niksaak/goticles"
 	"github.com/niksaak/goticles/vect"
+	"sort"
 )
 
 type node interface {
 	Position() vect.V
 	Mass() float64
-	Children() ([4]node, bool)
+	Quadrupole() quadrupole
 }
 
-func nodeLen(n node) int {
-	if n == nil {
-		return 0
+const (
+	LEAF_SIZE = 8  // default number of particles in a leaf
+	MAX_DEPTH = 32 // default and largest depth of leaves
+)
+
+// The cell type is a node of the tree. Inner cells refer to their children,
+// leaves to a range of particles in tree order. Coincident particles end up
+// in a common leaf at maximum depth, and exert no force on each other.
+type cell struct {
+	BB
+	position   vect.V // center of mass
+	mass       float64
+	quadrupole quadrupole
+	children   [4]int32 // indices of child cells by Side, 0 if none
+	first      int32    // index of first particle of a leaf in tree order
+	count      int32    // number of particles of a leaf
+	leaf       bool
+}
+
+var _ node = &cell{}
+
+func (c *cell) Position() vect.V { return c.position }
+
+func (c *cell) Mass() float64 { return c.mass }
+
+func (c *cell) Quadrupole() quadrupole { return c.quadrupole }
+
+// The tree type is a quadtree over particles, built into storage reused
+// across builds. Particles are sorted by their Morton keys, so that each cell
+// holds a contiguous range of them; the order is kept between builds, where
+// it is mostly sorted already.
+type tree struct {
+	mortonOrder
+	cells     []cell // the root is the first one
+	particles []particle
+	bb        BB
+	leafSize  int
+	maxDepth  int
+	tasks     []task   // subtrees built concurrently
+	scratch   [][]cell // cells of subtrees by task
+	// cached to keep builds free of allocations
+	keysFunc  func(lo, hi int)
+	tasksFunc func(lo, hi int)
+}
+
+// The task type is a subtree of cells to be built concurrently.
+type task struct {
+	cell        int32 // index of the placeholder cell of the subtree
+	bb          BB
+	first, last int32
+	depth       int
+}
+
+// build builds t over particles, with the root box fit to their extent,
+// using up to workers goroutines. The tree is the same for any number of
+// workers.
+func (t *tree) build(particles []particle, leafSize, maxDepth, workers int) {
+	t.particles = particles
+	t.leafSize = leafSize
+	t.maxDepth = maxDepth
+	if t.maxDepth > MAX_DEPTH {
+		t.maxDepth = MAX_DEPTH
 	}
-	if children, ok := n.Children(); !ok {
-		return 1
-	} else {
-		var count int
-		for _, child := range children {
-			count += nodeLen(child)
+	if len(t.order) != len(particles) {
+		t.order = make([]int32, len(particles))
+		t.keys = make([]uint64, len(particles))
+		for i := range t.order {
+			t.order[i] = int32(i)
 		}
-		return count
 	}
-}
+	if t.keysFunc == nil {
+		t.keysFunc = t.computeKeys
+		t.tasksFunc = t.runTasks
+	}
+	t.bb = bounds(particles)
+	goticles.Parallel(workers, len(particles), t.keysFunc)
+	sort.Sort(&t.mortonOrder)
 
-type quad struct {
-	BB
-	position vect.V // center of mass
-	mass     float64
-	children [4]node
+	// split the tree below taskDepth into subtrees for workers
+	taskDepth := -1
+	if workers = goticles.Workers(workers); workers > 1 {
+		taskDepth = 1
+		for 1<<uint(2*taskDepth) < 4*workers {
+			taskDepth++
+		}
+	}
+	t.tasks = t.tasks[:0]
+	t.cells, _ = t.split(t.cells[:0], t.bb, 0, int32(len(particles)), 0,
+		taskDepth)
+	if len(t.tasks) == 0 {
+		return
+	}
+	for len(t.scratch) < len(t.tasks) {
+		t.scratch = append(t.scratch, nil)
+	}
+	goticles.Parallel(workers, len(t.tasks), t.tasksFunc)
+	top := len(t.cells)
+	for k, task := range t.tasks {
+		sub := t.scratch[k]
+		base := int32(len(t.cells)) - 1 // sub[1] goes after the last cell
+		t.cells[task.cell] = sub[0].relocate(base)
+		for _, c := range sub[1:] {
+			t.cells = append(t.cells, c.relocate(base))
+		}
+	}
+	// parents precede children, so moments are updated bottom up
+	for i := top - 1; i >= 0; i-- {
+		if c := &t.cells[i]; !c.leaf {
+			t.innerMoments(t.cells, c)
+		}
+	}
 }
 
-var _ node = &quad{}
+// REFIT_SLACK is the fraction of its size by which particles may leave their
+// leaf before the tree has to be rebuilt.
+const REFIT_SLACK = 0.25
 
-func NewQuad(bb BB) *quad {
-	return &quad{BB: bb}
+// refit updates moments of t for particles, which are the particles t was
+// built over, moved. It keeps the topology of t, and reports false without
+// updating all moments if some particle has left its leaf by more than
+// REFIT_SLACK.
+func (t *tree) refit(particles []particle) bool {
+	if len(particles) != len(t.order) {
+		return false
+	}
+	t.particles = particles
+	// parents precede children, so moments are updated bottom up
+	for i := len(t.cells) - 1; i >= 0; i-- {
+		c := &t.cells[i]
+		if !c.leaf {
+			t.innerMoments(t.cells, c)
+			continue
+		}
+		bb := c.grow(REFIT_SLACK * c.Size())
+		for _, k := range t.order[c.first : c.first+c.count] {
+			if !bb.Query(particles[k].position) {
+				return false
+			}
+		}
+		t.leafMoments(c)
+	}
+	return true
 }
 
-func (q *quad) Position() vect.V { return q.position }
+func (t *tree) computeKeys(lo, hi int) {
+	for i := lo; i < hi; i++ {
+		t.keys[i] = mortonKey(t.bb, t.particles[i].position)
+	}
+}
 
-func (q *quad) Mass() float64 { return q.mass }
+func (t *tree) runTasks(lo, hi int) {
+	for k := lo; k < hi; k++ {
+		task := &t.tasks[k]
+		t.scratch[k], _ = t.split(t.scratch[k][:0], task.bb,
+			task.first, task.last, task.depth, -1)
+	}
+}
 
-func (q *quad) Children() ([4]node, bool) { return q.children, false }
+// split appends to cells a cell of box bb holding particles from first to
+// last in tree order, which lies at depth in the tree, and returns cells and
+// its index. Inner cells at taskDepth are left for tasks.
+func (t *tree) split(cells []cell, bb BB, first, last int32,
+	depth, taskDepth int) ([]cell, int32) {
+	i := int32(len(cells))
+	cells = append(cells, cell{BB: bb})
+	if int(last-first) <= t.leafSize || depth >= t.maxDepth {
+		c := &cells[i]
+		c.leaf = true
+		c.first = first
+		c.count = last - first
+		t.leafMoments(c)
+		return cells, i
+	}
+	if depth == taskDepth {
+		t.tasks = append(t.tasks, task{i, bb, first, last, depth})
+		return cells, i
+	}
+	var children [4]int32
+	for first < last {
+		side := t.side(first, depth)
+		end := first + 1
+		for end < last && t.side(end, depth) == side {
+			end++
+		}
+		cells, children[side] = t.split(cells, bb.Side(side), first, end,
+			depth+1, taskDepth)
+		first = end
+	}
+	c := &cells[i] // cells may have moved
+	c.children = children
+	t.innerMoments(cells, c)
+	return cells, i
+}
 
-func (q *quad) recalculate() {
-	var (
-		pos  vect.V
-		mass float64
-	)
-	for _, n := range q.children {
-		if n == nil {
-			continue
+// relocate returns c with indices of its children offset by base.
+func (c cell) relocate(base int32) cell {
+	for k, child := range c.children {
+		if child != 0 {
+			c.children[k] = child + base
 		}
-		pos = pos.Add(n.Position().Mul(n.Mass()))
-		mass += n.Mass()
 	}
-	q.position = pos.Div(mass)
-	q.mass = mass
+	return c
+}
+
+// side returns the Side of the particle at k in tree order, in a cell at
+// depth.
+func (t *tree) side(k int32, depth int) Side {
+	return Side(t.keys[t.order[k]]>>uint(62-2*depth)) & 3
 }
 
-func (q *quad) sideFor(v vect.V) (side Side) {
-	center := q.Center()
-	if v.X < center.X {
-		side |= west
+func (t *tree) leafMoments(c *cell) {
+	var pos vect.V
+	c.mass = 0
+	for _, k := range t.order[c.first : c.first+c.count] {
+		p := &t.particles[k]
+		pos = pos.Add(p.position.Mul(p.mass))
+		c.mass += p.mass
 	}
-	if v.Y < center.Y {
-		side |= south
+	c.position = c.Center()
+	if c.mass != 0 {
+		c.position = pos.Div(c.mass)
+	}
+	c.quadrupole = quadrupole{}
+	for _, k := range t.order[c.first : c.first+c.count] {
+		p := &t.particles[k]
+		c.quadrupole = c.quadrupole.add(p.mass, p.position.Sub(c.position))
 	}
-	return side
 }
 
-func (q *quad) insert(p *particle) {
-	if q == nil {
-		panic("insert: quad is nil")
+// innerMoments computes moments of c from its children in cells.
+func (t *tree) innerMoments(cells []cell, c *cell) {
+	var pos vect.V
+	c.mass = 0
+	for _, i := range c.children {
+		if i != 0 {
+			n := &cells[i]
+			pos = pos.Add(n.position.Mul(n.mass))
+			c.mass += n.mass
+		}
 	}
-	if !q.Query(p.position) {
-		return
+	c.position = c.Center()
+	if c.mass != 0 {
+		c.position = pos.Div(c.mass)
 	}
-	side := q.sideFor(p.position)
-	if q.children[side] == nil {
-		q.children[side] = p
-		q.recalculate()
-		return
+	c.quadrupole = quadrupole{}
+	for _, i := range c.children {
+		if i != 0 {
+			n := &cells[i]
+			c.quadrupole = c.quadrupole.plus(n.quadrupole).add(
+				n.mass, n.position.Sub(c.position))
+		}
 	}
+}
+
+// mortonKey returns the Morton key of v in bb, interleaving bits of its
+// coordinates so that each pair of bits from the top is its Side in a cell
+// at successive depths.
+func mortonKey(bb BB, v vect.V) uint64 {
+	size := bb.Size()
+	// bits are set for west and south halves
+	x := quantize((bb[1].X - v.X) / size)
+	y := quantize((v.Y - bb[1].Y) / size)
+	return spread(^y)<<1 | spread(x)
+}
 
-	switch n := q.children[side].(type) {
-	case *quad:
-		n.insert(p)
-	case *particle:
-		q.children[side] = NewQuad(q.Side(q.sideFor(p.position)))
-		q.insert(p)
-		q.insert(n)
+// quantize maps u from [0, 1] to a 32 bit fixed point fraction.
+func quantize(u float64) uint32 {
+	const SCALE = 1 << 32
+	f := u * SCALE
+	switch {
+	case f <= 0:
+		return 0
+	case f >= SCALE-1:
+		return SCALE - 1
 	}
-	q.recalculate()
+	return uint32(f)
 }
 
-func (q *quad) insertSlice(particles []particle) {
-	for i := range particles {
-		q.insert(&particles[i])
+// spread returns bits of v spaced out to every other bit.
+func spread(v uint32) uint64 {
+	x := uint64(v)
+	x = (x | x<<16) & 0x0000ffff0000ffff
+	x = (x | x<<8) & 0x00ff00ff00ff00ff
+	x = (x | x<<4) & 0x0f0f0f0f0f0f0f0f
+	x = (x | x<<2) & 0x3333333333333333
+	x = (x | x<<1) & 0x5555555555555555
+	return x
+}
+
+// The mortonOrder type sorts particle indices by their Morton keys.
+type mortonOrder struct {
+	order []int32  // particle indices in tree order
+	keys  []uint64 // Morton keys by particle index
+}
+
+func (m mortonOrder) Len() int { return len(m.order) }
+
+func (m mortonOrder) Less(i, j int) bool {
+	return m.keys[m.order[i]] < m.keys[m.order[j]]
+}
+
+func (m mortonOrder) Swap(i, j int) {
+	m.order[i], m.order[j] = m.order[j], m.order[i]
+}
+
+// buildTree builds the tree of s over particles and returns it.
+func (s *Space) buildTree(particles []particle) *tree {
+	s.tree.build(particles, s.LeafSize, s.MaxDepth, s.Workers)
+	s.built = true
+	s.sinceBuild = 0
+	return &s.tree
+}
+
+// updateTree refits the tree of s to particles when s.Refit allows, and
+// builds it anew otherwise.
+func (s *Space) updateTree(particles []particle) {
+	if s.Refit > 0 && s.built && s.sinceBuild < s.Refit &&
+		s.tree.refit(particles) {
+		return
 	}
+	s.buildTree(particles)
 }
 
 type particle struct {
-	position vect.V
-	velocity vect.V
-	mass     float64
+	position     vect.V
+	velocity     vect.V
+	acceleration vect.V // previous estimate until computed
+	mass         float64
 }
 
 var _ node = &particle{}
@@ -115,48 +349,42 @@ func (p *particle) Position() vect.V { return p.position }
 
 func (p *particle) Mass() float64 { return p.mass }
 
-func (p *particle) Children() ([4]node, bool) { return [4]node{}, false }
+func (p *particle) Quadrupole() quadrupole { return quadrupole{} }
 
-const (
-	THETA = 0.6
-	G     = 6.67384e-11
-	TRESHOLD_VALUE = 2e-3 // TODO: rename this to something more sensible
-	TRESHOLD = TRESHOLD_VALUE * TRESHOLD_VALUE
-)
+// accel returns the acceleration of p towards n.
+func (p *particle) accel(n node, g *goticles.Gravity) vect.V {
+	distV := n.Position().Sub(p.position)
+	return distV.Mul(g.G * n.Mass() * g.Factor(distV.LenSq()))
+}
 
-func (p *particle) force(n node) vect.V {
-	distV := p.position.Sub(n.Position())
-	distSq := distV.LenSq()
-	if distSq < TRESHOLD {
-		return vect.V{}
-	}
-	distU := distV.Ulen()
-	return distU.Mul(G * p.mass * n.Mass() / distSq)
-}
-
-func (p *particle) treeForce(tree node) vect.V {
-	if tree == nil {
-		return vect.V{}
-	}
-	switch n := tree.(type) {
-	case *quad:
-		dist := p.position.Dst(n.position)
-		size := n.Size()
-		if size/dist < THETA {
-			return p.force(n)
-		} else {
-			force := vect.V{}
-			for _, child := range n.children {
-				force = force.Add(p.treeForce(child))
+// treeAccel returns the acceleration of p towards all particles in cell i of
+// t.
+func (s *Space) treeAccel(p *particle, t *tree, i int32) vect.V {
+	c := &t.cells[i]
+	if c.leaf {
+		accel := vect.V{}
+		for _, k := range t.order[c.first : c.first+c.count] {
+			if q := &t.particles[k]; q != p {
+				accel = accel.Add(p.accel(q, &s.Gravity))
 			}
-			return force
 		}
-	case *particle:
-		if n == p {
-			return vect.V{}
+		return accel
+	}
+	if s.accept(p, c) {
+		switch s.Order {
+		case Monopole:
+			return p.accel(c, &s.Gravity)
+		case Quadrupole:
+			return p.accelQuadrupole(c, &s.Gravity)
+		default:
+			panic(fmt.Errorf("treeAccel: bad order - %v", s.Order))
+		}
+	}
+	accel := vect.V{}
+	for _, child := range c.children {
+		if child != 0 {
+			accel = accel.Add(s.treeAccel(p, t, child))
 		}
-		return p.force(n)
-	default:
-		panic(fmt.Errorf("treeForce: bad argument type - %T", tree))
 	}
+	return accel
 }
@@ -0,0 +1,76 @@
+package bnticles
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	THETA     = 0.6   // default opening angle
+	TOLERANCE = 0.005 // default relative acceleration error
+)
+
+// The Criterion type selects when a tree node is far enough from a particle
+// to be taken as a whole rather than opened.
+type Criterion int
+
+const (
+	// BarnesHut accepts nodes whose size is less than Theta times their
+	// distance from the particle to their center of mass.
+	BarnesHut Criterion = iota
+	// BMax is the criterion of Salmon & Warren, accepting nodes whose
+	// largest distance from the center of mass to a corner is less than
+	// Theta times the distance to the particle. Unlike BarnesHut, it
+	// accounts for the center of mass being off the node's center.
+	BMax
+	// Relative is the criterion of GADGET, accepting nodes whose estimated
+	// error is less than Tolerance times the acceleration of the particle
+	// at its previous evaluation. Nodes containing the particle are always
+	// opened; particles with no previous acceleration use BarnesHut.
+	Relative
+)
+
+func (c Criterion) String() string {
+	switch c {
+	case BarnesHut:
+		return "BarnesHut"
+	case BMax:
+		return "BMax"
+	case Relative:
+		return "Relative"
+	default:
+		return fmt.Sprintf("Criterion(%d)", int(c))
+	}
+}
+
+// accept reports whether p may interact with q as a whole.
+func (s *Space) accept(p *particle, q *cell) bool {
+	dist := p.position.Dst(q.position)
+	size := q.Size()
+	switch s.Criterion {
+	case BarnesHut:
+		return size < s.Theta*dist
+	case BMax:
+		var bmax float64
+		for _, corner := range q.corners() {
+			bmax = math.Max(bmax, corner.Dst(q.position))
+		}
+		return bmax < s.Theta*dist
+	case Relative:
+		accel := p.acceleration.Len()
+		if accel == 0 {
+			return size < s.Theta*dist
+		}
+		// treat the particle as inside when within 10% of the node
+		center := q.Center()
+		if math.Abs(p.position.X-center.X) < 0.6*size &&
+			math.Abs(p.position.Y-center.Y) < 0.6*size {
+			return false
+		}
+		n := s.ForceExponent()
+		return s.G*q.mass*math.Pow(dist, -n)*(size*size) <
+			s.Tolerance*accel*(dist*dist)
+	default:
+		panic(fmt.Errorf("accept: bad criterion - %v", s.Criterion))
+	}
+}
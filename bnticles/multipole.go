@@ -0,0 +1,75 @@
+package bnticles
+
+import (
+	"fmt"
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/vect"
+)
+
+// The Order type selects the order of multipole expansion used for tree nodes
+// far enough from a particle.
+type Order int
+
+const (
+	// Monopole approximates a node by its mass at its center of mass.
+	Monopole Order = iota
+	// Quadrupole adds the second moments of a node's mass distribution
+	// about its center of mass, for error of higher order in node size.
+	Quadrupole
+)
+
+func (o Order) String() string {
+	switch o {
+	case Monopole:
+		return "Monopole"
+	case Quadrupole:
+		return "Quadrupole"
+	default:
+		return fmt.Sprintf("Order(%d)", int(o))
+	}
+}
+
+// The quadrupole type holds the second moments of mass of a node about its
+// center of mass, as the symmetric tensor sum of m*d*dᵀ.
+type quadrupole struct {
+	xx, xy, yy float64
+}
+
+// add returns q with the second moment of mass m at displacement d added.
+func (q quadrupole) add(m float64, d vect.V) quadrupole {
+	return quadrupole{
+		xx: q.xx + m*d.X*d.X,
+		xy: q.xy + m*d.X*d.Y,
+		yy: q.yy + m*d.Y*d.Y,
+	}
+}
+
+// plus returns the sum of q and r.
+func (q quadrupole) plus(r quadrupole) quadrupole {
+	return quadrupole{xx: q.xx + r.xx, xy: q.xy + r.xy, yy: q.yy + r.yy}
+}
+
+// mul returns q applied to v.
+func (q quadrupole) mul(v vect.V) vect.V {
+	return vect.V{q.xx*v.X + q.xy*v.Y, q.xy*v.X + q.yy*v.Y}
+}
+
+// accelQuadrupole returns the acceleration of p towards n, including the
+// quadrupole moment of n. The quadrupole term follows the unsoftened force
+// law, which is accurate for nodes far beyond the softening length.
+func (p *particle) accelQuadrupole(n node, g *goticles.Gravity) vect.V {
+	d := n.Position().Sub(p.position)
+	rSq := d.LenSq()
+	f := g.G * g.Factor(rSq)
+	if f == 0 {
+		return vect.V{}
+	}
+	q := n.Quadrupole()
+	// derivatives of Factor by rSq are -k*Factor/rSq and
+	// k*(k+1)*Factor/rSq², with Factor ~ 1/rSq^k
+	k := (g.ForceExponent() + 1) / 2
+	qd := q.mul(d)
+	return d.Mul(n.Mass()).Sub(
+		qd.Mul(2).Add(d.Mul(q.xx + q.yy)).Mul(k / rSq)).Add(
+		d.Mul(2 * k * (k + 1) * d.Dot(qd) / (rSq * rSq))).Mul(f)
+}
@@ -7,6 +7,8 @@ import (
 	"github.com/go-gl/mathgl/mgl32"
 	"github.com/niksaak/goticles"
 	"github.com/niksaak/goticles/demo/engine"
+	"github.com/niksaak/goticles/diagnostics"
+	"github.com/niksaak/goticles/units"
 	"github.com/niksaak/goticles/vect"
 	"math/rand"
 	"os"
@@ -21,9 +23,9 @@ import (
 	"github.com/niksaak/goticles/leapfrog"
 )
 
-var _ Spacer = rk4.New()
-var _ Spacer = bnticles.New()
-var _ Spacer = leapfrog.New()
+var _ goticles.Space = rk4.New()
+var _ goticles.Space = bnticles.New()
+var _ goticles.Space = leapfrog.New()
 
 func randFloat() float64 {
 	return rand.Float64() - 0.5
@@ -33,19 +35,16 @@ func randVect() vect.V {
 	return vect.V{randFloat(), randFloat()}.Ulen().Mul(rand.Float64())
 }
 
-type Spacer interface {
-	Particle(id int) *goticles.P
-	MkParticle(mass float64) *goticles.P
-	Step(dt float64)
-}
-
 const (
 	PARTICLE_MASS_DEFAULT  = 1
 	PARTICLE_COUNT_DEFAULT = 3072
+	DIAGNOSTICS_PERIOD     = 300 // updates between diagnostics reports
 )
 
 type MainState struct {
-	space        Spacer
+	space        diagnostics.Space
+	initial      diagnostics.Report
+	updates      int
 	vertexArray  uint32
 	vertexBuffer uint32
 	program      uint32
@@ -119,10 +118,13 @@ func (s *MainState) Init(eng *engine.E) error {
 	// Initialize space
 	space := leapfrog.New()
 	for i := 0; i < PARTICLE_COUNT_DEFAULT; i++ {
-		particle := space.MkParticle(PARTICLE_MASS_DEFAULT)
+		particle := space.MkParticle(PARTICLE_MASS_DEFAULT).P()
 		particle.Position = randVect().Div(2)
 	}
+	// in SI units the particles would barely move
+	space.SetUnits(units.NBody(PARTICLE_COUNT_DEFAULT*PARTICLE_MASS_DEFAULT, 1))
 	s.space = space
+	s.initial = diagnostics.MeasureSpace(space)
 
 	// Deinit is not part of interface, but can be deferred manually:
 	eng.Defer(s.Deinit)
@@ -135,6 +137,12 @@ func (s *MainState) Deinit() {
 
 func (s *MainState) Update(dt float64) error {
 	s.space.Step(dt)
+	s.updates++
+	if s.updates%DIAGNOSTICS_PERIOD == 0 {
+		r := diagnostics.MeasureSpace(s.space)
+		fmt.Printf("t: %.2f; energy drift: %.3g; virial ratio: %.3f\n",
+			r.Time, r.Drift(s.initial), r.Virial())
+	}
 	return nil
 }
 
@@ -0,0 +1,135 @@
+// Package diagnostics measures energy, momentum and other quantities of
+// particle systems, to tell whether a simulation stays physically sane.
+package diagnostics
+
+import (
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/vect"
+	"math"
+)
+
+// Interaction is implemented by goticles.Gravity, and so by every Space
+// embedding it.
+type Interaction interface {
+	// Potential returns the potential energy of two particles of unit mass
+	// at squared distance rSq.
+	Potential(rSq float64) float64
+}
+
+// Space is a goticles.Space which provides its gravitational interaction.
+type Space interface {
+	goticles.Space
+	Interaction
+}
+
+// The Report type holds the diagnostics of a particle system at some moment.
+type Report struct {
+	Time            float64
+	Mass            float64
+	Kinetic         float64 // kinetic energy
+	Potential       float64 // potential energy
+	Momentum        vect.V  // total linear momentum
+	AngularMomentum float64 // total angular momentum around the origin
+	CenterOfMass    vect.V
+}
+
+// Energy returns the total energy.
+func (r Report) Energy() float64 {
+	return r.Kinetic + r.Potential
+}
+
+// Virial returns the virial ratio 2K/|U|, which is 1 for a system in virial
+// equilibrium.
+func (r Report) Virial() float64 {
+	return 2 * r.Kinetic / math.Abs(r.Potential)
+}
+
+// Drift returns the relative change in energy since report r0.
+func (r Report) Drift(r0 Report) float64 {
+	return math.Abs((r.Energy() - r0.Energy()) / r0.Energy())
+}
+
+// Measure returns the report for particles interacting through g.
+func Measure(particles []goticles.P, g Interaction) Report {
+	return Report{
+		Mass:            Mass(particles),
+		Kinetic:         Kinetic(particles),
+		Potential:       Potential(particles, g),
+		Momentum:        Momentum(particles),
+		AngularMomentum: AngularMomentum(particles),
+		CenterOfMass:    CenterOfMass(particles),
+	}
+}
+
+// MeasureSpace returns the report for the current state of s.
+func MeasureSpace(s Space) Report {
+	r := Measure(s.All(), s)
+	r.Time = s.Time()
+	return r
+}
+
+// Mass returns the total mass of particles.
+func Mass(particles []goticles.P) (mass float64) {
+	for i := range particles {
+		mass += particles[i].Mass
+	}
+	return mass
+}
+
+// Kinetic returns the kinetic energy of particles.
+func Kinetic(particles []goticles.P) (energy float64) {
+	for i := range particles {
+		p := &particles[i]
+		energy += 0.5 * p.Mass * p.Velocity.LenSq()
+	}
+	return energy
+}
+
+// Potential returns the potential energy of particles interacting through g.
+func Potential(particles []goticles.P, g Interaction) (energy float64) {
+	for i := range particles {
+		p := &particles[i]
+		for j := i + 1; j < len(particles); j++ {
+			q := &particles[j]
+			energy += p.Mass * q.Mass * g.Potential(p.Position.DstSq(q.Position))
+		}
+	}
+	return energy
+}
+
+// Momentum returns the total linear momentum of particles.
+func Momentum(particles []goticles.P) (momentum vect.V) {
+	for i := range particles {
+		p := &particles[i]
+		momentum = momentum.Add(p.Velocity.Mul(p.Mass))
+	}
+	return momentum
+}
+
+// AngularMomentum returns the total angular momentum of particles around the
+// origin.
+func AngularMomentum(particles []goticles.P) (momentum float64) {
+	for i := range particles {
+		p := &particles[i]
+		momentum += p.Mass *
+			(p.Position.X*p.Velocity.Y - p.Position.Y*p.Velocity.X)
+	}
+	return momentum
+}
+
+// CenterOfMass returns the center of mass of particles.
+func CenterOfMass(particles []goticles.P) vect.V {
+	var (
+		center vect.V
+		mass   float64
+	)
+	for i := range particles {
+		p := &particles[i]
+		center = center.Add(p.Position.Mul(p.Mass))
+		mass += p.Mass
+	}
+	if mass == 0 {
+		return vect.V{}
+	}
+	return center.Div(mass)
+}
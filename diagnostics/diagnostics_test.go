@@ -0,0 +1,66 @@
+package diagnostics
+
+import (
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/rk4"
+	"github.com/niksaak/goticles/vect"
+	"math"
+	"testing"
+)
+
+func TestMeasure(t *testing.T) {
+	g := goticles.Gravity{G: 1}
+	particles := []goticles.P{
+		{Position: vect.V{-1, 0}, Velocity: vect.V{0, -1}, Mass: 1},
+		{Position: vect.V{1, 0}, Velocity: vect.V{0, 1}, Mass: 1},
+	}
+	r := Measure(particles, &g)
+	if r.Kinetic != 1 {
+		t.Errorf("kinetic energy is not 1 but %v", r.Kinetic)
+	}
+	if r.Potential != -0.5 {
+		t.Errorf("potential energy is not -0.5 but %v", r.Potential)
+	}
+	if !r.Momentum.Eql(vect.V{}) {
+		t.Errorf("momentum is not zero but %v", r.Momentum)
+	}
+	if r.AngularMomentum != 2 {
+		t.Errorf("angular momentum is not 2 but %v", r.AngularMomentum)
+	}
+	if !r.CenterOfMass.Eql(vect.V{}) {
+		t.Errorf("center of mass is not at origin but at %v", r.CenterOfMass)
+	}
+	if v := r.Virial(); v != 4 {
+		t.Errorf("virial ratio is not 4 but %v", v)
+	}
+}
+
+func TestEnergyDrift(t *testing.T) {
+	const STEP = 1.0 / 100
+	space := rk4.New()
+	space.G = 1
+	space.Kernel = goticles.PlummerKernel
+	space.Softening = 0.05
+	// a binary on a nearly circular orbit
+	for _, x := range []float64{-0.5, 0.5} {
+		p := space.MkParticle(1).P()
+		p.Position = vect.V{x, 0}
+		p.Velocity = vect.V{0, math.Copysign(math.Sqrt(0.5), x)}
+	}
+	r0 := MeasureSpace(space)
+	for i := 0; i < 1000; i++ {
+		space.Step(STEP)
+	}
+	r := MeasureSpace(space)
+	if drift := r.Drift(r0); drift > 1e-6 {
+		t.Errorf("energy drifted by %v", drift)
+	}
+	if dp := r.Momentum.Sub(r0.Momentum).Len(); dp > 1e-9 {
+		t.Errorf("momentum drifted by %v", dp)
+	}
+	if dl := math.Abs(r.AngularMomentum - r0.AngularMomentum); dl > 1e-6 {
+		t.Errorf("angular momentum drifted by %v", dl)
+	}
+	t.Logf("t: %.2f; energy drift: %.3g; virial ratio: %.3f",
+		r.Time, r.Drift(r0), r.Virial())
+}
@@ -0,0 +1,159 @@
+package goticles
+
+import (
+	"github.com/niksaak/goticles/vect"
+)
+
+// ForceField is a source of force acting on particles. Spaces compute gravity
+// themselves, and apply their Fields on top of it.
+type ForceField interface {
+	// Accelerate adds the acceleration the field imparts on particles[i] to
+	// acc[i].
+	Accelerate(particles []P, acc []vect.V)
+}
+
+// Scaler is implemented by force fields with parameters measured in some
+// units, so that they can be converted to others. Scale returns the field
+// with lengths, masses and times in it multiplied by given factors; fields
+// held by pointer are converted in place.
+type Scaler interface {
+	Scale(length, mass, time float64) ForceField
+}
+
+// Fields is a stack of force fields, itself acting as their sum.
+type Fields []ForceField
+
+func (fs Fields) Accelerate(particles []P, acc []vect.V) {
+	for _, f := range fs {
+		f.Accelerate(particles, acc)
+	}
+}
+
+// Scale converts the fields of fs implementing Scaler in place, and returns
+// fs. Other fields are left as they are.
+func (fs Fields) Scale(length, mass, time float64) ForceField {
+	for i, f := range fs {
+		if f, ok := f.(Scaler); ok {
+			fs[i] = f.Scale(length, mass, time)
+		}
+	}
+	return fs
+}
+
+// ExternalField is a ForceField acting on every particle independently. The
+// function returns the force exerted on p.
+type ExternalField func(p *P) vect.V
+
+func (f ExternalField) Accelerate(particles []P, acc []vect.V) {
+	for i := range particles {
+		p := &particles[i]
+		if p.Mass == 0 {
+			continue
+		}
+		acc[i] = acc[i].Add(f(p).Div(p.Mass))
+	}
+}
+
+// PairField is a ForceField acting between every pair of particles. The
+// function returns the force q exerts on p; p exerts the opposite force on q.
+type PairField func(p, q *P) vect.V
+
+func (f PairField) Accelerate(particles []P, acc []vect.V) {
+	for i := range particles {
+		p := &particles[i]
+		for j := i + 1; j < len(particles); j++ {
+			q := &particles[j]
+			force := f(p, q)
+			if p.Mass != 0 {
+				acc[i] = acc[i].Add(force.Div(p.Mass))
+			}
+			if q.Mass != 0 {
+				acc[j] = acc[j].Sub(force.Div(q.Mass))
+			}
+		}
+	}
+}
+
+// Accelerate makes Gravity a ForceField, summing the gravitational pull
+// between every pair of particles directly.
+func (g *Gravity) Accelerate(particles []P, acc []vect.V) {
+	for i := range particles {
+		p := &particles[i]
+		for j := i + 1; j < len(particles); j++ {
+			q := &particles[j]
+			f := g.pull(q.Position.Sub(p.Position))
+			acc[i] = acc[i].Add(f.Mul(q.Mass))
+			acc[j] = acc[j].Sub(f.Mul(p.Mass))
+		}
+	}
+}
+
+// Uniform is a uniform field, such as gravity near a planet's surface, which
+// accelerates every particle equally.
+type Uniform vect.V
+
+func (u Uniform) Accelerate(particles []P, acc []vect.V) {
+	for i := range acc {
+		acc[i] = acc[i].Add(vect.V(u))
+	}
+}
+
+func (u Uniform) Scale(length, mass, time float64) ForceField {
+	return Uniform(vect.V(u).Mul(length / (time * time)))
+}
+
+// Drag is linear drag, exerting a force of -Drag times velocity on every
+// particle.
+type Drag float64
+
+func (k Drag) Accelerate(particles []P, acc []vect.V) {
+	ExternalField(func(p *P) vect.V {
+		return p.Velocity.Mul(-float64(k))
+	}).Accelerate(particles, acc)
+}
+
+func (k Drag) Scale(length, mass, time float64) ForceField {
+	return k * Drag(mass/time)
+}
+
+// Spring is a Hookean spring of stiffness K and rest length Length,
+// connecting particles with Ids A and B. It does nothing while either of them
+// is missing.
+type Spring struct {
+	A, B      int
+	K, Length float64
+}
+
+func (s *Spring) Accelerate(particles []P, acc []vect.V) {
+	a, b := -1, -1
+	for i := range particles {
+		switch particles[i].Id {
+		case s.A:
+			a = i
+		case s.B:
+			b = i
+		}
+	}
+	if a < 0 || b < 0 {
+		return
+	}
+	pa, pb := &particles[a], &particles[b]
+	d := pb.Position.Sub(pa.Position)
+	dist := d.Len()
+	if dist == 0 {
+		return
+	}
+	force := d.Mul(s.K * (dist - s.Length) / dist)
+	if pa.Mass != 0 {
+		acc[a] = acc[a].Add(force.Div(pa.Mass))
+	}
+	if pb.Mass != 0 {
+		acc[b] = acc[b].Sub(force.Div(pb.Mass))
+	}
+}
+
+func (s *Spring) Scale(length, mass, time float64) ForceField {
+	s.K *= mass / (time * time)
+	s.Length *= length
+	return s
+}
@@ -0,0 +1,56 @@
+package goticles
+
+import (
+	"github.com/niksaak/goticles/vect"
+	"math"
+	"testing"
+)
+
+func twoParticles() []P {
+	return []P{
+		{Id: 0, Position: vect.V{0, 0}, Velocity: vect.V{1, 0}, Mass: 1},
+		{Id: 1, Position: vect.V{2, 0}, Velocity: vect.V{0, 1}, Mass: 2},
+	}
+}
+
+func TestGravityField(t *testing.T) {
+	g := Gravity{G: 1}
+	particles := twoParticles()
+	acc := make([]vect.V, len(particles))
+	g.Accelerate(particles, acc)
+	// a = G*m/r²
+	if !acc[0].Eql(vect.V{0.5, 0}) || !acc[1].Eql(vect.V{-0.25, 0}) {
+		t.Errorf("bad gravitational acceleration: %v", acc)
+	}
+}
+
+func TestFieldsStacking(t *testing.T) {
+	particles := twoParticles()
+	acc := make([]vect.V, len(particles))
+	fields := Fields{
+		Uniform{0, -1},
+		Drag(1),
+		&Spring{A: 0, B: 1, K: 2, Length: 1},
+	}
+	fields.Accelerate(particles, acc)
+	// uniform + drag + spring pulling particles together with force 2
+	want := []vect.V{{-1 + 2, -1}, {-1, -1 - 0.5}}
+	for i := range acc {
+		if acc[i].Sub(want[i]).Len() > 1e-12 {
+			t.Errorf("acceleration of particle %d is %v, not %v",
+				i, acc[i], want[i])
+		}
+	}
+}
+
+func TestPairFieldMomentum(t *testing.T) {
+	particles := twoParticles()
+	acc := make([]vect.V, len(particles))
+	PairField(func(p, q *P) vect.V {
+		return q.Position.Sub(p.Position).Mul(p.Mass * q.Mass)
+	}).Accelerate(particles, acc)
+	momentum := acc[0].Mul(particles[0].Mass).Add(acc[1].Mul(particles[1].Mass))
+	if math.Abs(momentum.X) > 1e-12 || math.Abs(momentum.Y) > 1e-12 {
+		t.Errorf("pair field does not conserve momentum: %v", momentum)
+	}
+}
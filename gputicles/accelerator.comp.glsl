@@ -12,17 +12,64 @@ layout(std430, binding=0) buffer particles {
 	Particle p[];
 };
 
-const float G        = 6.67384e-11;
 const float DBL_MIN  = 2.2250738585072014e-308;
-const float TRESHOLD = 2e-3;
+
+const int CUTOFF_KERNEL  = 0;
+const int PLUMMER_KERNEL = 1;
+const int SPLINE_KERNEL  = 2;
+
+uniform int   count;
+uniform float G;
+uniform float softening;
+uniform int   kernel;
+uniform int   law;
+uniform float exponent;
+
+const int NEWTONIAN_LAW   = 0;
+const int LOGARITHMIC_LAW = 1;
+const int POWER_LAW       = 2;
+
+// softened 1/r^3, matching goticles.Kernel.Factor
+float kernelFactor(float rSq) {
+	if (rSq == 0) {
+		return 0;
+	}
+	float eps = softening;
+	if (kernel == CUTOFF_KERNEL && rSq < eps*eps) {
+		return 0;
+	} else if (kernel == PLUMMER_KERNEL) {
+		return inversesqrt(rSq + eps*eps) / (rSq + eps*eps);
+	} else if (kernel == SPLINE_KERNEL && rSq < eps*eps) {
+		float u = sqrt(rSq) / eps;
+		float h3 = eps * eps * eps;
+		if (u < 0.5) {
+			return (32.0/3 + u*u*(32*u - 38.4)) / h3;
+		}
+		return (64.0/3 - 48*u + 38.4*u*u - 32.0/3*u*u*u - 1.0/15/(u*u*u)) / h3;
+	}
+	return inversesqrt(rSq) / rSq;
+}
+
+// softened 1/r^(n+1), matching goticles.Gravity.Factor
+float factor(float rSq) {
+	float f = kernelFactor(rSq);
+	if (law == LOGARITHMIC_LAW) {
+		return f * sqrt(rSq);
+	} else if (law == POWER_LAW) {
+		return f * pow(rSq, (2 - exponent) / 2);
+	}
+	return f;
+}
 
 void main() {
-	int N = int(gl_NumWorkGroups.x*gl_WorkGroupSize.x);
+	int N = count;
 	int id = int(gl_GlobalInvocationID);
+	if (id >= N) {
+		return;
+	}
 
 	vec2 position = p[id].position;
 	vec2 acceleration = vec2(0, 0);
-	float mass = p[id].mass;
 
 	// accelerate
 	for (int j = 0; j < N; ++j) {
@@ -31,12 +78,7 @@ void main() {
 		}
 		vec2 other = p[j].position;
 		vec2 vDist = position - other;
-		float dist = length(vDist);
-		if (dist < TRESHOLD) {
-			continue;
-		}
-		vec2 uDist = normalize(vDist);
-		acceleration -= G * mass * p[j].mass / (dist * dist) * uDist;
+		acceleration -= G * p[j].mass * factor(dot(vDist, vDist)) * vDist;
 	}
 	p[id].acceleration = acceleration;
 }
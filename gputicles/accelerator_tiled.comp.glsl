@@ -12,39 +12,89 @@ layout(std430, binding=0) buffer particles {
 	Particle p[];
 };
 
-const float G        = 6.67384e-11;
 const float DBL_MIN  = 2.2250738585072014e-308;
-const float TRESHOLD = 2e-3;
+
+const int CUTOFF_KERNEL  = 0;
+const int PLUMMER_KERNEL = 1;
+const int SPLINE_KERNEL  = 2;
+
+uniform int   count;
+uniform float G;
+uniform float softening;
+uniform int   kernel;
+uniform int   law;
+uniform float exponent;
+
+const int NEWTONIAN_LAW   = 0;
+const int LOGARITHMIC_LAW = 1;
+const int POWER_LAW       = 2;
+
+// softened 1/r^3, matching goticles.Kernel.Factor
+float kernelFactor(float rSq) {
+	if (rSq == 0) {
+		return 0;
+	}
+	float eps = softening;
+	if (kernel == CUTOFF_KERNEL && rSq < eps*eps) {
+		return 0;
+	} else if (kernel == PLUMMER_KERNEL) {
+		return inversesqrt(rSq + eps*eps) / (rSq + eps*eps);
+	} else if (kernel == SPLINE_KERNEL && rSq < eps*eps) {
+		float u = sqrt(rSq) / eps;
+		float h3 = eps * eps * eps;
+		if (u < 0.5) {
+			return (32.0/3 + u*u*(32*u - 38.4)) / h3;
+		}
+		return (64.0/3 - 48*u + 38.4*u*u - 32.0/3*u*u*u - 1.0/15/(u*u*u)) / h3;
+	}
+	return inversesqrt(rSq) / rSq;
+}
+
+// softened 1/r^(n+1), matching goticles.Gravity.Factor
+float factor(float rSq) {
+	float f = kernelFactor(rSq);
+	if (law == LOGARITHMIC_LAW) {
+		return f * sqrt(rSq);
+	} else if (law == POWER_LAW) {
+		return f * pow(rSq, (2 - exponent) / 2);
+	}
+	return f;
+}
 
 shared Particle tmp[gl_WorkGroupSize.x];
 
 void main() {
-	int N = int(gl_NumWorkGroups.x*gl_WorkGroupSize.x);
+	int N = count;
 	int id = int(gl_GlobalInvocationID);
 
-	vec2 position = p[id].position;
+	// invocations past the last particle still take part in loading tiles
+	vec2 position = vec2(0, 0);
 	vec2 acceleration = vec2(0, 0);
-	float mass = p[id].mass;
+	if (id < N) {
+		position = p[id].position;
+	}
 
 	for (int tile = 0; tile < N; tile += int(gl_WorkGroupSize.x)) {
-		tmp[gl_LocalInvocationIndex] = p[tile + int(gl_LocalInvocationIndex)];
+		int j = tile + int(gl_LocalInvocationIndex);
+		if (j < N) {
+			tmp[gl_LocalInvocationIndex] = p[j];
+		}
 		groupMemoryBarrier();
 		barrier();
-		for(int i = 0; i < gl_WorkGroupSize.x; i++) {
-			if (i == id) {
+		// lanes of the last tile past N are never loaded, so skip them
+		int size = min(int(gl_WorkGroupSize.x), N - tile);
+		for(int i = 0; i < size; i++) {
+			if (tile + i == id) {
 				continue;
 			}
 			vec2 other = tmp[i].position;
 			vec2 vDist = position - other;
-			float dist = length(vDist);
-			if (dist < TRESHOLD) {
-				continue;
-			}
-			vec2 uDist = normalize(vDist);
-			acceleration -= G * mass * tmp[i].mass / (dist * dist) * uDist;
+			acceleration -= G * tmp[i].mass * factor(dot(vDist, vDist)) * vDist;
 		}
 		groupMemoryBarrier();
 		barrier();
 	}
-	p[id].acceleration = acceleration;
+	if (id < N) {
+		p[id].acceleration = acceleration;
+	}
 }
@@ -8,6 +8,7 @@ import (
 	//	"github.com/niksaak/goticles"
 	"github.com/niksaak/goticles/demo/engine"
 	"github.com/niksaak/goticles/gputicles"
+	"github.com/niksaak/goticles/units"
 	"github.com/niksaak/goticles/vect"
 	"math/rand"
 	"os"
@@ -106,19 +107,21 @@ func (s *MainState) Init(e *engine.E) error {
 	s.space = space
 	/*
 		for i := 0; i < PARTICLE_COUNT_DEFAULT; i++ {
-			particle := space.MkParticle(PARTICLE_MASS_DEFAULT)
+			particle := space.MkParticle(PARTICLE_MASS_DEFAULT).P()
 			particle.Position = randVect()
 			//particle.Velocity = randVect().Div(8)
 		}
 	*/
 	for i := 0; i < PARTICLE_COUNT_DEFAULT/2; i++ {
-		particle := space.MkParticle(PARTICLE_MASS_DEFAULT)
+		particle := space.MkParticle(PARTICLE_MASS_DEFAULT).P()
 		particle.Position = randVect().Div(2).Add(vect.V{-0.5, -0.5})
 	}
 	for i := PARTICLE_COUNT_DEFAULT / 2; i < PARTICLE_COUNT_DEFAULT; i++ {
-		particle := space.MkParticle(PARTICLE_MASS_DEFAULT)
+		particle := space.MkParticle(PARTICLE_MASS_DEFAULT).P()
 		particle.Position = randVect().Div(2).Add(vect.V{0.5, 0.5})
 	}
+	// in SI units the particles would barely move
+	space.SetUnits(units.NBody(PARTICLE_COUNT_DEFAULT*PARTICLE_MASS_DEFAULT, 1))
 
 	return nil
 }
@@ -5,6 +5,7 @@ import (
 	"github.com/go-gl/glow/gl-core/4.4/gl"
 	"github.com/niksaak/goticles"
 	"github.com/niksaak/goticles/demo/engine"
+	"github.com/niksaak/goticles/units"
 	"github.com/niksaak/goticles/vect"
 	"reflect"
 	"unsafe"
@@ -12,17 +13,29 @@ import (
 
 const (
 	WORK_GROUP_LOCAL_SIZE = 256
-	TILED_SHADER = true
+	TILED_SHADER          = true
 )
 
 type Space struct {
-	Particles []goticles.P
+	units.Base
+	fieldAccel  []vect.V
+	gravities   []vect.V
+	accelerated bool              // whether gravities are up to date
+	snapshot    goticles.Snapshot // particles at the end of the last step
 
-	accelProgram uint32
-	vao          uint32
-	vbo          uint32
+	accelProgram     uint32
+	countUniform     int32
+	gUniform         int32
+	softeningUniform int32
+	kernelUniform    int32
+	lawUniform       int32
+	exponentUniform  int32
+	vao              uint32
+	vbo              uint32
 }
 
+var _ units.Space = &Space{}
+
 type gpuParticle struct {
 	position     [2]float32
 	acceleration [2]float32
@@ -31,11 +44,17 @@ type gpuParticle struct {
 }
 
 func New() (s *Space, err error) {
-	s = new(Space)
+	s = &Space{Base: units.NewBase()}
 	s.accelProgram, err = loadShader()
 	if err != nil {
 		return nil, err
 	}
+	s.countUniform = gl.GetUniformLocation(s.accelProgram, gl.Str("count\x00"))
+	s.gUniform = gl.GetUniformLocation(s.accelProgram, gl.Str("G\x00"))
+	s.softeningUniform = gl.GetUniformLocation(s.accelProgram, gl.Str("softening\x00"))
+	s.kernelUniform = gl.GetUniformLocation(s.accelProgram, gl.Str("kernel\x00"))
+	s.lawUniform = gl.GetUniformLocation(s.accelProgram, gl.Str("law\x00"))
+	s.exponentUniform = gl.GetUniformLocation(s.accelProgram, gl.Str("exponent\x00"))
 	gl.GenVertexArrays(1, &s.vao)
 	gl.GenBuffers(1, &s.vbo)
 
@@ -46,26 +65,60 @@ func New() (s *Space, err error) {
 	return s, nil
 }
 
-func (s *Space) MkParticle(mass float64) *goticles.P {
-	id := len(s.Particles)
-	s.Particles = append(s.Particles, goticles.P{
-		Id:   id,
-		Mass: mass,
-	})
-	return &s.Particles[id]
-}
-
-func (s *Space) RmParticle(p *goticles.P) {
-	// TODO
-}
-
+// Step advances the simulation by dt with the kick-drift-kick leapfrog.
+// Gravity computed at its end is reused by the next step unless particles or
+// gravity have changed since, the particle buffer being refilled from
+// s.Particles whenever it is computed; external forces and fields are applied
+// afresh at every kick.
 func (s *Space) Step(dt float64) {
+	if !s.snapshot.Holds(&s.Gravity, s.Particles) {
+		s.accelerated = false
+	}
 	var prevProgram int32
 	gl.GetIntegerv(gl.CURRENT_PROGRAM, &prevProgram)
 	gl.UseProgram(s.accelProgram)
 	gl.BindVertexArray(s.vao)
 	gl.BindBufferBase(gl.SHADER_STORAGE_BUFFER, 0, s.vbo)
 
+	s.accelerate()
+	s.kick(dt / 2)
+	s.drift(dt)
+	s.accelerate()
+	s.kick(dt / 2)
+
+	gl.UseProgram(uint32(prevProgram))
+	s.snapshot.Take(&s.Gravity, s.Particles)
+	s.Advance(dt)
+}
+
+// accelerate computes the total acceleration of every particle, storing it in
+// its Acceleration. Gravity is only computed on the GPU if it is not up to
+// date, while external forces and fields, which may have changed, always are.
+func (s *Space) accelerate() {
+	if len(s.gravities) != len(s.Particles) {
+		s.gravities = make([]vect.V, len(s.Particles))
+		s.accelerated = false
+	}
+	if s.accelerated {
+		s.evaluateFields()
+	} else {
+		s.gravitate()
+	}
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Acceleration = s.gravities[i].Add(
+			p.ExternalAcceleration()).Add(s.fieldAccel[i])
+	}
+}
+
+// gravitate computes the gravity of every particle on the GPU, storing it in
+// s.gravities, and evaluates fields while it runs.
+func (s *Space) gravitate() {
+	if len(s.Particles) == 0 {
+		// there is nothing to compute, and an empty buffer can't be mapped
+		s.accelerated = true
+		return
+	}
 	gl.BufferData(
 		gl.SHADER_STORAGE_BUFFER,
 		len(s.Particles)*int(unsafe.Sizeof(gpuParticle{})),
@@ -84,7 +137,15 @@ func (s *Space) Step(dt float64) {
 		}
 		gl.UnmapBuffer(gl.SHADER_STORAGE_BUFFER)
 	}
-	gl.DispatchCompute(uint32(len(s.Particles))/WORK_GROUP_LOCAL_SIZE, 1, 1)
+	gl.Uniform1i(s.countUniform, int32(len(s.Particles)))
+	gl.Uniform1f(s.gUniform, float32(s.G))
+	gl.Uniform1f(s.softeningUniform, float32(s.Softening))
+	gl.Uniform1i(s.kernelUniform, int32(s.Kernel))
+	gl.Uniform1i(s.lawUniform, int32(s.Law))
+	gl.Uniform1f(s.exponentUniform, float32(s.Exponent))
+	groups := (len(s.Particles) + WORK_GROUP_LOCAL_SIZE - 1) / WORK_GROUP_LOCAL_SIZE
+	gl.DispatchCompute(uint32(groups), 1, 1)
+	s.evaluateFields()
 	gl.MemoryBarrier(gl.SHADER_STORAGE_BARRIER_BIT)
 	{ // receive
 		mappedParticles, err := sliceMapParticlesBuffer(gl.READ_ONLY, len(s.Particles))
@@ -92,20 +153,38 @@ func (s *Space) Step(dt float64) {
 			panic(err)
 		}
 		for i, q := range mappedParticles {
-			p := &s.Particles[i]
-			p.Position = p.Position.Add(p.Velocity.Mul(dt)).Add(
-				p.Acceleration.Mul(dt * dt).Mul(0.5))
-			oldAcceleration := p.Acceleration
-			p.Acceleration = vect.V{
+			s.gravities[i] = vect.V{
 				float64(q.acceleration[0]), float64(q.acceleration[1]),
 			}
-			p.Velocity = p.Velocity.Add(
-				p.Acceleration.Add(oldAcceleration).Mul(0.5).Mul(dt))
 		}
 		gl.UnmapBuffer(gl.SHADER_STORAGE_BUFFER)
 	}
+	s.accelerated = true
+}
 
-	gl.UseProgram(uint32(prevProgram))
+func (s *Space) kick(dt float64) {
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Velocity = p.Velocity.Add(p.Acceleration.Mul(dt))
+	}
+}
+
+func (s *Space) drift(dt float64) {
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Position = p.Position.Add(p.Velocity.Mul(dt))
+	}
+	s.accelerated = false
+}
+
+func (s *Space) evaluateFields() {
+	if len(s.fieldAccel) != len(s.Particles) {
+		s.fieldAccel = make([]vect.V, len(s.Particles))
+	}
+	for i := range s.fieldAccel {
+		s.fieldAccel[i] = vect.V{}
+	}
+	s.Fields.Accelerate(s.Particles, s.fieldAccel)
 }
 
 func sliceMapParticlesBuffer(mode uint32, length int) ([]gpuParticle, error) {
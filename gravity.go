@@ -0,0 +1,240 @@
+package goticles
+
+import (
+	"fmt"
+	"github.com/niksaak/goticles/vect"
+	"math"
+)
+
+const (
+	G         = 6.67384e-11 // gravitational constant, in SI units
+	SOFTENING = 2e-3        // default softening length
+)
+
+// The ForceLaw type selects how gravitational force falls off with distance.
+type ForceLaw int
+
+const (
+	// Newtonian is the 1/r² law of three-dimensional gravity, with 1/r
+	// potential.
+	Newtonian ForceLaw = iota
+	// Logarithmic is the 1/r law of true two-dimensional gravity, with
+	// logarithmic potential.
+	Logarithmic
+	// PowerLaw is the generic 1/rⁿ law, where n is Gravity.Exponent.
+	PowerLaw
+)
+
+func (l ForceLaw) String() string {
+	switch l {
+	case Newtonian:
+		return "Newtonian"
+	case Logarithmic:
+		return "Logarithmic"
+	case PowerLaw:
+		return "PowerLaw"
+	default:
+		return fmt.Sprintf("ForceLaw(%d)", int(l))
+	}
+}
+
+// The Gravity type holds the parameters of gravitational interaction between
+// particles. Spaces embed it, so that each of them can be tuned separately.
+//
+// The acceleration of a particle towards a body of mass m at separation d is
+// G*m*Factor(|d|²)*d, which for Newtonian law and no softening has magnitude
+// G*m/|d|².
+type Gravity struct {
+	G         float64  // gravitational constant
+	Softening float64  // softening length
+	Kernel    Kernel   // softening kernel
+	Law       ForceLaw // force law
+	Exponent  float64  // exponent of PowerLaw
+}
+
+// NewGravity returns Newtonian Gravity with the SI gravitational constant and
+// default softening length, using CutoffKernel.
+func NewGravity() Gravity {
+	return Gravity{
+		G:         G,
+		Softening: SOFTENING,
+	}
+}
+
+// Factor returns the factor by which the separation of particles at squared
+// distance rSq is scaled to get their acceleration per unit of G and mass. It
+// is the softened 1/rⁿ⁺¹ for the force law in use; see Kernel.Factor.
+func (g *Gravity) Factor(rSq float64) float64 {
+	f := g.Kernel.Factor(rSq, g.Softening)
+	switch g.Law {
+	case Newtonian:
+		return f
+	case Logarithmic:
+		return f * math.Sqrt(rSq)
+	case PowerLaw:
+		return f * math.Pow(rSq, (2-g.Exponent)/2)
+	default:
+		panic(fmt.Errorf("Factor: bad force law - %v", g.Law))
+	}
+}
+
+// Pull returns the gravitational acceleration of p towards q. Coincident
+// particles don't pull each other.
+func (g *Gravity) Pull(p, q *P) vect.V {
+	return g.pull(q.Position.Sub(p.Position)).Mul(q.Mass)
+}
+
+// pull returns the acceleration towards a body of unit mass at separation d.
+func (g *Gravity) pull(d vect.V) vect.V {
+	rSq := d.LenSq()
+	if rSq == 0 {
+		return vect.V{}
+	}
+	return d.Mul(g.G * g.Factor(rSq))
+}
+
+// Accel returns the gravitational acceleration of particles[i] towards all
+// other particles. Pulls are summed in the order of particles, so that
+// accelerations don't depend on how particles are split between workers.
+func (g *Gravity) Accel(particles []P, i int) vect.V {
+	p := &particles[i]
+	accel := vect.V{}
+	for j := range particles {
+		if j != i {
+			accel = accel.Add(g.Pull(p, &particles[j]))
+		}
+	}
+	return accel
+}
+
+// AccelJerk returns Accel(particles, i) along with its rate of change, the
+// jerk, as particles move with their velocities.
+func (g *Gravity) AccelJerk(particles []P, i int) (accel, jerk vect.V) {
+	p := &particles[i]
+	for j := range particles {
+		q := &particles[j]
+		d := q.Position.Sub(p.Position)
+		rSq := d.LenSq()
+		if j == i || rSq == 0 {
+			continue
+		}
+		v := q.Velocity.Sub(p.Velocity)
+		gm := g.G * q.Mass
+		f := gm * g.Factor(rSq)
+		df := 2 * gm * g.FactorDerivative(rSq) * d.Dot(v)
+		accel = accel.Add(d.Mul(f))
+		jerk = jerk.Add(v.Mul(f)).Add(d.Mul(df))
+	}
+	return accel, jerk
+}
+
+// FactorDerivative returns the derivative of Factor with respect to rSq; see
+// Kernel.Derivative.
+func (g *Gravity) FactorDerivative(rSq float64) float64 {
+	f := g.Kernel.Factor(rSq, g.Softening)
+	df := g.Kernel.Derivative(rSq, g.Softening)
+	if rSq == 0 {
+		return df
+	}
+	switch g.Law {
+	case Newtonian:
+		return df
+	case Logarithmic:
+		r := math.Sqrt(rSq)
+		return df*r + f/(2*r)
+	case PowerLaw:
+		q := (2 - g.Exponent) / 2
+		pow := math.Pow(rSq, q)
+		return df*pow + f*q*pow/rSq
+	default:
+		panic(fmt.Errorf("FactorDerivative: bad force law - %v", g.Law))
+	}
+}
+
+// Potential returns the gravitational potential energy of two particles of
+// unit mass at squared distance rSq, consistent with Factor. It vanishes at
+// infinity where possible; for Logarithmic law, and PowerLaw with Exponent of
+// at most one, the potential grows without bound and is zero at unit
+// distance instead.
+func (g *Gravity) Potential(rSq float64) float64 {
+	r := math.Sqrt(rSq)
+	eps := g.Softening
+	if r == 0 && eps == 0 {
+		return 0
+	}
+	n := g.ForceExponent()
+	switch g.Kernel {
+	case CutoffKernel:
+		return g.G * barePotential(math.Max(r, eps), n)
+	case PlummerKernel:
+		switch {
+		case g.Law == Newtonian:
+			return -g.G / math.Sqrt(rSq+eps*eps)
+		case g.Law == Logarithmic && eps != 0:
+			return g.G * (math.Asinh(r/eps) - r/math.Hypot(r, eps) +
+				1 + math.Log(eps/2))
+		}
+		// no closed form, integrate out to where softening is negligible
+		far := math.Max(r, eps) * 1e4
+		return g.G * (barePotential(far, n) - g.integrateFactor(r, far))
+	case SplineKernel:
+		if r >= eps {
+			return g.G * barePotential(r, n)
+		}
+		if g.Law == Newtonian {
+			u := r / eps
+			if u < 0.5 {
+				return g.G * (-2.8 + u*u*(16.0/3+u*u*(6.4*u-9.6))) / eps
+			}
+			return g.G * (-3.2 + 1/(15*u) +
+				u*u*(32.0/3+u*(-16+u*(9.6-32.0/15*u)))) / eps
+		}
+		return g.G * (barePotential(eps, n) - g.integrateFactor(r, eps))
+	default:
+		panic(fmt.Errorf("Potential: bad kernel - %v", g.Kernel))
+	}
+}
+
+// ForceExponent returns n of the 1/rⁿ force law in use.
+func (g *Gravity) ForceExponent() float64 {
+	switch g.Law {
+	case Newtonian:
+		return 2
+	case Logarithmic:
+		return 1
+	case PowerLaw:
+		return g.Exponent
+	default:
+		panic(fmt.Errorf("ForceExponent: bad force law - %v", g.Law))
+	}
+}
+
+// barePotential returns the unsoftened potential of the 1/rⁿ force law.
+func barePotential(r, n float64) float64 {
+	if n == 1 {
+		return math.Log(r)
+	}
+	return math.Pow(r, 1-n) / (1 - n)
+}
+
+// integrateFactor integrates softened force magnitude from a to b, using
+// Simpson's rule on a logarithmic scale.
+func (g *Gravity) integrateFactor(a, b float64) float64 {
+	const INTERVALS = 512
+	a = math.Max(a, b*1e-9)
+	lo, hi := math.Log(a), math.Log(b)
+	h := (hi - lo) / INTERVALS
+	f := func(u float64) float64 {
+		s := math.Exp(u)
+		return g.Factor(s*s) * s * s
+	}
+	sum := f(lo) + f(hi)
+	for i := 1; i < INTERVALS; i++ {
+		if i%2 == 1 {
+			sum += 4 * f(lo+float64(i)*h)
+		} else {
+			sum += 2 * f(lo+float64(i)*h)
+		}
+	}
+	return sum * h / 3
+}
@@ -0,0 +1,93 @@
+package goticles
+
+import (
+	"github.com/niksaak/goticles/vect"
+	"math"
+	"testing"
+)
+
+func TestPotentialGradient(t *testing.T) {
+	const DR = 1e-5
+	for _, k := range []Kernel{CutoffKernel, PlummerKernel, SplineKernel} {
+		for _, l := range []ForceLaw{Newtonian, Logarithmic, PowerLaw} {
+			g := Gravity{G: 1, Softening: 1, Kernel: k, Law: l, Exponent: 3}
+			for _, r := range []float64{0.3, 0.7, 2} {
+				p1 := g.Potential((r - DR) * (r - DR))
+				p2 := g.Potential((r + DR) * (r + DR))
+				gradient := (p2 - p1) / (2 * DR)
+				force := g.Factor(r*r) * r
+				if math.Abs(gradient-force) > 1e-5*math.Max(1, force) {
+					t.Errorf("%v, %v: potential gradient at r = %v is %v, "+
+						"force is %v", k, l, r, gradient, force)
+				}
+			}
+		}
+	}
+}
+
+func TestPotentialContinuity(t *testing.T) {
+	const DR = 1e-7
+	for _, k := range []Kernel{PlummerKernel, SplineKernel} {
+		for _, l := range []ForceLaw{Newtonian, Logarithmic, PowerLaw} {
+			g := Gravity{G: 1, Softening: 1, Kernel: k, Law: l, Exponent: 3}
+			for _, r := range []float64{0.5, 1} {
+				p1 := g.Potential((r - DR) * (r - DR))
+				p2 := g.Potential((r + DR) * (r + DR))
+				if math.Abs(p1-p2) > 1e-5 {
+					t.Errorf("%v, %v: potential jumps from %v to %v at r = %v",
+						k, l, p1, p2, r)
+				}
+			}
+		}
+	}
+}
+
+func TestFactorDerivative(t *testing.T) {
+	const DS = 1e-6
+	for _, k := range []Kernel{CutoffKernel, PlummerKernel, SplineKernel} {
+		for _, l := range []ForceLaw{Newtonian, Logarithmic, PowerLaw} {
+			g := Gravity{G: 1, Softening: 1, Kernel: k, Law: l, Exponent: 3}
+			for _, r := range []float64{0.3, 0.7, 2} {
+				rSq := r * r
+				f1 := g.Factor(rSq - DS)
+				f2 := g.Factor(rSq + DS)
+				slope := (f2 - f1) / (2 * DS)
+				df := g.FactorDerivative(rSq)
+				if math.Abs(slope-df) > 1e-5*math.Max(1, math.Abs(df)) {
+					t.Errorf("%v, %v: factor slope at r = %v is %v, "+
+						"derivative is %v", k, l, r, slope, df)
+				}
+			}
+		}
+	}
+}
+
+func TestAccelJerk(t *testing.T) {
+	const DT = 1e-6
+	g := Gravity{G: 1, Softening: 0.1, Kernel: PlummerKernel, Law: PowerLaw,
+		Exponent: 3}
+	particles := []P{
+		{Mass: 1, Position: vect.V{0, 0}, Velocity: vect.V{0, 0.5}},
+		{Mass: 2, Position: vect.V{1, 0}, Velocity: vect.V{-0.3, 0}},
+		{Mass: 3, Position: vect.V{0, 1}, Velocity: vect.V{0.2, 0.1}},
+		// coincident with the last one, moving along
+		{Mass: 4, Position: vect.V{0, 1}, Velocity: vect.V{0.2, 0.1}},
+	}
+	moved := make([]P, len(particles))
+	for i, p := range particles {
+		moved[i] = p
+		moved[i].Position = p.Position.Add(p.Velocity.Mul(DT))
+	}
+	for i := range particles {
+		accel, jerk := g.AccelJerk(particles, i)
+		if a := g.Accel(particles, i); !accel.Eql(a) &&
+			accel.Sub(a).Len() > 1e-12 {
+			t.Errorf("particle %d: accel is %v, Accel is %v", i, accel, a)
+		}
+		rate := g.Accel(moved, i).Sub(accel).Mul(1 / DT)
+		if rate.Sub(jerk).Len() > 1e-4*math.Max(1, jerk.Len()) {
+			t.Errorf("particle %d: jerk is %v, accel changes by %v",
+				i, jerk, rate)
+		}
+	}
+}
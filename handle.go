@@ -0,0 +1,57 @@
+package goticles
+
+import (
+	"fmt"
+)
+
+// StaleHandleError is the panic value of Handle.P when the particle the
+// handle refers to has been removed from its Space.
+type StaleHandleError int
+
+func (e StaleHandleError) Error() string {
+	return fmt.Sprintf("stale handle: no particle of id %d", int(e))
+}
+
+// The Handle type is a stable reference to a particle in a Space. Pointers
+// returned by Space.Particle point into storage which moves around as
+// particles are created and removed; a Handle looks the particle up by its Id
+// every time, so it stays valid for as long as the particle exists.
+type Handle struct {
+	space particles
+	id    int
+}
+
+// The particles interface is the part of Space a Handle looks particles up
+// with, implemented by Index too.
+type particles interface {
+	Particle(id int) *P
+}
+
+// NewHandle returns a handle to the particle with given id in space.
+func NewHandle(space particles, id int) Handle {
+	return Handle{space, id}
+}
+
+// Id returns the Id of the particle h refers to.
+func (h Handle) Id() int {
+	return h.id
+}
+
+// Valid reports whether the particle h refers to still exists.
+func (h Handle) Valid() bool {
+	return h.space != nil && h.space.Particle(h.id) != nil
+}
+
+// P returns a pointer to the particle h refers to. The pointer itself is only
+// valid until the next call to MkParticle or RmParticle, so it should not be
+// kept around. P panics with StaleHandleError if the particle was removed.
+func (h Handle) P() *P {
+	if h.space == nil {
+		panic(StaleHandleError(h.id))
+	}
+	p := h.space.Particle(h.id)
+	if p == nil {
+		panic(StaleHandleError(h.id))
+	}
+	return p
+}
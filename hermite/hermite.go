@@ -0,0 +1,177 @@
+// Package hermite integrates particles with the fourth order Hermite
+// predictor-corrector scheme, which suits collisional systems such as star
+// clusters and few-body problems. It computes the jerk, the rate of change of
+// acceleration, along with the acceleration, and uses both to predict and
+// correct positions and velocities with a single force evaluation per step.
+package hermite
+
+import (
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/units"
+	"github.com/niksaak/goticles/vect"
+	"math"
+)
+
+type Space struct {
+	units.Base
+	// Eta is the accuracy parameter of Aarseth's timestep criterion. When it
+	// is positive, Step splits its time into substeps no longer than the
+	// criterion allows for any particle; 0.01 to 0.02 are typical values.
+	// When it is zero, each Step is taken at once.
+	Eta        float64
+	Workers    int // goroutines computing forces, see goticles.Workers
+	gravities  []vect.V
+	jerks      []vect.V
+	snaps      []vect.V // second derivatives of acceleration
+	crackles   []vect.V // third derivatives of acceleration
+	positions  []vect.V // state at the start of a substep
+	velocities []vect.V
+	accels     []vect.V
+	oldJerks   []vect.V
+	fieldAccel []vect.V
+	derived    bool // whether snaps and crackles are known
+	substeps   int
+	// particles as they were when gravities and jerks were last kept
+	snapshot goticles.Snapshot
+}
+
+var _ units.Space = &Space{}
+
+func New() *Space {
+	return &Space{Base: units.NewBase()}
+}
+
+// Substeps returns the number of substeps taken by the last Step.
+func (s *Space) Substeps() int {
+	return s.substeps
+}
+
+// accelerate computes the gravity and its jerk of every particle, storing
+// them in s.gravities and s.jerks, and then its total acceleration. Fields
+// and external forces only add to the acceleration, and are taken to change
+// slowly.
+func (s *Space) accelerate() {
+	ln := len(s.Particles)
+	if len(s.jerks) != ln {
+		s.gravities = make([]vect.V, ln)
+		s.jerks = make([]vect.V, ln)
+		s.snaps = make([]vect.V, ln)
+		s.crackles = make([]vect.V, ln)
+		s.positions = make([]vect.V, ln)
+		s.velocities = make([]vect.V, ln)
+		s.accels = make([]vect.V, ln)
+		s.oldJerks = make([]vect.V, ln)
+		s.fieldAccel = make([]vect.V, ln)
+	}
+	goticles.Parallel(s.Workers, ln, func(lo, hi int) {
+		for i := lo; i < hi; i++ {
+			s.gravities[i], s.jerks[i] = s.AccelJerk(s.Particles, i)
+		}
+	})
+	s.accelerateExternal()
+}
+
+// accelerateExternal sets the Acceleration of every particle to the sum of
+// its gravity, its external acceleration and that of s.Fields.
+func (s *Space) accelerateExternal() {
+	for i := range s.Particles {
+		s.fieldAccel[i] = vect.V{}
+	}
+	s.Fields.Accelerate(s.Particles, s.fieldAccel)
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Acceleration = s.gravities[i].Add(
+			p.ExternalAcceleration()).Add(s.fieldAccel[i])
+	}
+}
+
+// timestep returns the smallest timestep allowed by Aarseth's criterion for
+// any particle, or +Inf if none constrains it. Until snaps and crackles are
+// known, it falls back to the ratio of acceleration and jerk.
+func (s *Space) timestep() float64 {
+	dt := math.Inf(1)
+	for i := range s.Particles {
+		a := s.Particles[i].Acceleration.Len()
+		j := s.jerks[i].Len()
+		var t float64
+		if s.derived {
+			sn, c := s.snaps[i].Len(), s.crackles[i].Len()
+			t = math.Sqrt(s.Eta * (a*sn + j*j) / (j*c + sn*sn))
+		} else {
+			t = math.Sqrt(s.Eta) * a / j
+		}
+		if t > 0 && t < dt {
+			dt = t
+		}
+	}
+	return dt
+}
+
+// hermite advances the simulation by a substep of dt, starting from
+// accelerations and jerks that are up to date.
+func (s *Space) hermite(dt float64) {
+	dt2 := dt * dt / 2
+	dt3 := dt2 * dt / 3
+	// predict
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		s.positions[i] = p.Position
+		s.velocities[i] = p.Velocity
+		s.accels[i] = p.Acceleration
+		p.Position = p.Position.Add(p.Velocity.Mul(dt)).Add(
+			p.Acceleration.Mul(dt2)).Add(s.jerks[i].Mul(dt3))
+		p.Velocity = p.Velocity.Add(p.Acceleration.Mul(dt)).Add(
+			s.jerks[i].Mul(dt2))
+		s.oldJerks[i] = s.jerks[i]
+	}
+	// evaluate at the predicted state, and correct
+	s.accelerate()
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		a0, a1 := s.accels[i], p.Acceleration
+		j0, j1 := s.oldJerks[i], s.jerks[i]
+		v0 := s.velocities[i]
+		da := a0.Sub(a1)
+		v1 := v0.Add(a0.Add(a1).Mul(dt / 2)).Add(j0.Sub(j1).Mul(dt * dt / 12))
+		p.Position = s.positions[i].Add(v0.Add(v1).Mul(dt / 2)).Add(
+			da.Mul(dt * dt / 12))
+		p.Velocity = v1
+		// derivatives of acceleration from its interpolating polynomial
+		snap := da.Mul(-6).Sub(j0.Mul(4 * dt).Add(j1.Mul(2 * dt))).Div(dt * dt)
+		crackle := da.Mul(12).Add(j0.Add(j1).Mul(6 * dt)).Div(dt * dt * dt)
+		s.snaps[i] = snap.Add(crackle.Mul(dt))
+		s.crackles[i] = crackle
+	}
+	s.derived = true
+}
+
+// Step advances the simulation by dt. Gravity and jerks evaluated at its end
+// are reused by the next step, unless particles or gravity are changed in
+// between; external forces and fields are applied afresh at the start of
+// every step.
+func (s *Space) Step(dt float64) {
+	s.substeps = 0
+	if dt == 0 {
+		return
+	}
+	if !s.snapshot.Holds(&s.Gravity, s.Particles) {
+		s.accelerate()
+		s.derived = false
+	} else {
+		s.accelerateExternal()
+	}
+	for left := dt; ; {
+		h := left
+		if s.Eta > 0 {
+			h = goticles.Substep(left, s.timestep())
+		}
+		s.hermite(h)
+		s.substeps++
+		if h == left {
+			break
+		}
+		left -= h
+	}
+	s.snapshot.Take(&s.Gravity, s.Particles)
+	s.Advance(dt)
+}
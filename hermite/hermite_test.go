@@ -0,0 +1,100 @@
+package hermite
+
+import (
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/diagnostics"
+	"github.com/niksaak/goticles/internal/kepler"
+	"github.com/niksaak/goticles/vect"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// binary returns a space holding kepler.Binary.
+func binary() *Space {
+	space := New()
+	space.G, space.Softening = 1, 0
+	kepler.Binary(space)
+	return space
+}
+
+func TestOrder(t *testing.T) {
+	const STEPS = 200
+	coarse := kepler.OrbitError(binary(), STEPS)
+	fine := kepler.OrbitError(binary(), 2*STEPS)
+	order := math.Log2(coarse / fine)
+	t.Logf("errors %.3g and %.3g, order %.2f", coarse, fine, order)
+	if math.Abs(order-4) > 0.5 {
+		t.Errorf("order is %.2f, not 4", order)
+	}
+}
+
+func TestJerk(t *testing.T) {
+	const COUNT = 16
+	const DT = 1e-6
+	rng := rand.New(rand.NewSource(1))
+	for _, k := range []goticles.Kernel{
+		goticles.PlummerKernel, goticles.SplineKernel,
+	} {
+		space := New()
+		space.G = 1
+		space.Softening = 0.2
+		space.Kernel = k
+		for i := 0; i < COUNT; i++ {
+			p := space.MkParticle(1.0 / COUNT).P()
+			p.Position = vect.V{rng.Float64(), rng.Float64()}
+			p.Velocity = vect.V{rng.NormFloat64(), rng.NormFloat64()}
+		}
+		// acceleration at positions moved along velocities by dt
+		accel := func(dt float64) []vect.V {
+			saved := append([]goticles.P(nil), space.Particles...)
+			for i := range space.Particles {
+				p := &space.Particles[i]
+				p.Position = p.Position.Add(p.Velocity.Mul(dt))
+			}
+			space.accelerate()
+			a := make([]vect.V, COUNT)
+			for i := range a {
+				a[i] = space.Particles[i].Acceleration
+			}
+			copy(space.Particles, saved)
+			return a
+		}
+		before, after := accel(-DT), accel(DT)
+		accel(0)
+		for i, jerk := range space.jerks {
+			slope := after[i].Sub(before[i]).Div(2 * DT)
+			if slope.Dst(jerk) > 1e-5*math.Max(1, jerk.Len()) {
+				t.Errorf("%v: jerk of particle %d is %v, acceleration "+
+					"changes by %v", k, i, jerk, slope)
+			}
+		}
+	}
+}
+
+func TestTimestep(t *testing.T) {
+	const STEPS = 20
+	fixed, adaptive := binary(), binary()
+	adaptive.Eta = 0.01
+	r0 := diagnostics.MeasureSpace(fixed)
+	substeps := 0
+	for i := 0; i < STEPS; i++ {
+		fixed.Step(kepler.Period / STEPS)
+		adaptive.Step(kepler.Period / STEPS)
+		if adaptive.Time() != fixed.Time() {
+			t.Fatalf("time is %v, not %v", adaptive.Time(), fixed.Time())
+		}
+		substeps += adaptive.Substeps()
+	}
+	if fixed.Substeps() != 1 {
+		t.Errorf("fixed step took %d substeps", fixed.Substeps())
+	}
+	fixedDrift := diagnostics.MeasureSpace(fixed).Drift(r0)
+	adaptiveDrift := diagnostics.MeasureSpace(adaptive).Drift(r0)
+	t.Logf("energy drift %.3g fixed, %.3g in %d substeps",
+		fixedDrift, adaptiveDrift, substeps)
+	if substeps <= STEPS || adaptiveDrift > fixedDrift/100 {
+		t.Errorf("adaptive drift %v in %d substeps, fixed %v",
+			adaptiveDrift, substeps, fixedDrift)
+	}
+}
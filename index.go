@@ -0,0 +1,71 @@
+package goticles
+
+// The Index type holds the particles of a Space, and maps their stable Ids to
+// the slots they occupy in its Particles slice. Particles are removed by
+// moving the last particle into the freed slot, so slots change while Ids stay
+// the same. Embedded in a Space, it provides Particle, MkParticle, RmParticle,
+// Len and All; a Space keeping data of its own per particle wraps MkParticle
+// and RmParticle to update it.
+type Index struct {
+	Particles []P
+	slots     map[int]int
+	nextId    int
+}
+
+// Particle returns the particle with given id, or nil if there is none.
+func (x *Index) Particle(id int) *P {
+	i, ok := x.Slot(id)
+	if !ok {
+		return nil
+	}
+	return &x.Particles[i]
+}
+
+// MkParticle appends a new particle of given mass and returns a handle to it.
+func (x *Index) MkParticle(mass float64) Handle {
+	if x.slots == nil {
+		x.slots = make(map[int]int)
+	}
+	id := x.nextId
+	x.nextId++
+	x.slots[id] = len(x.Particles)
+	x.Particles = append(x.Particles, P{Id: id, Mass: mass})
+	return NewHandle(x, id)
+}
+
+// RmParticle removes the particle with given id, if there is one.
+func (x *Index) RmParticle(id int) {
+	x.Remove(id)
+}
+
+// Remove removes the particle with given id and returns the slot it occupied.
+// The particle from the last slot is moved to the freed slot; a Space keeping
+// data of its own per slot is expected to do the same with it.
+func (x *Index) Remove(id int) (slot int, ok bool) {
+	slot, ok = x.slots[id]
+	if !ok {
+		return 0, false
+	}
+	last := len(x.Particles) - 1
+	x.slots[x.Particles[last].Id] = slot
+	delete(x.slots, id)
+	x.Particles[slot] = x.Particles[last]
+	x.Particles = x.Particles[:last]
+	return slot, true
+}
+
+// Slot returns the slot of the particle with given id.
+func (x *Index) Slot(id int) (slot int, ok bool) {
+	slot, ok = x.slots[id]
+	return slot, ok
+}
+
+// Len returns the number of particles.
+func (x *Index) Len() int {
+	return len(x.Particles)
+}
+
+// All returns all particles, in no particular order.
+func (x *Index) All() []P {
+	return x.Particles
+}
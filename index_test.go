@@ -0,0 +1,65 @@
+package goticles
+
+import (
+	"github.com/niksaak/goticles/vect"
+	"testing"
+)
+
+func TestIndex(t *testing.T) {
+	const COUNT = 4
+	var x Index
+	for i := 0; i < COUNT; i++ {
+		p := x.MkParticle(float64(i + 1)).P()
+		p.Position = vect.V{float64(i) / COUNT, 0}
+	}
+	x.RmParticle(1)
+	if count := x.Len(); count != COUNT-1 || len(x.All()) != count {
+		t.Errorf("particle count is not %d but %d", COUNT-1, count)
+	}
+	if p := x.Particle(1); p != nil {
+		t.Errorf("removed particle is still present: %v", p)
+	}
+	for _, id := range []int{0, 2, 3} {
+		p := x.Particle(id)
+		if p == nil {
+			t.Fatalf("particle %d is missing", id)
+		}
+		if p.Id != id || p.Mass != float64(id+1) ||
+			p.Position.X != float64(id)/COUNT {
+			t.Errorf("particle %d is not what it was: %v", id, p)
+		}
+	}
+	if _, ok := x.Remove(1); ok {
+		t.Errorf("particle 1 was removed twice")
+	}
+	if h := x.MkParticle(1); h.Id() != COUNT {
+		t.Errorf("new particle reuses id %d", h.Id())
+	}
+}
+
+func TestHandle(t *testing.T) {
+	var x Index
+	h := x.MkParticle(1)
+	h.P().Velocity = vect.V{1, 0}
+	// grow the particle slice well past its initial capacity
+	for i := 0; i < 1024; i++ {
+		x.MkParticle(1)
+	}
+	x.RmParticle(1)
+	if v := h.P().Velocity; !v.Eql(vect.V{1, 0}) {
+		t.Errorf("particle velocity is not {1 0} but %v", v)
+	}
+	x.RmParticle(h.Id())
+	if h.Valid() {
+		t.Errorf("handle to removed particle is still valid")
+	}
+	if (Handle{}).Valid() {
+		t.Errorf("zero handle is valid")
+	}
+	defer func() {
+		if _, ok := recover().(StaleHandleError); !ok {
+			t.Errorf("stale handle access did not panic")
+		}
+	}()
+	h.P().Velocity = vect.V{}
+}
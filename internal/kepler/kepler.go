@@ -0,0 +1,34 @@
+// Package kepler provides a two body orbit on which the tests of integrators
+// measure their errors.
+package kepler
+
+import (
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/vect"
+	"math"
+)
+
+// Period is the period of the orbit of particles placed by Binary.
+var Period = 2 * math.Pi * math.Sqrt(4.0/27)
+
+// Binary fills s with two unit masses at apocenter of an orbit of
+// eccentricity 0.5 and separation 1. The orbit has the period Period when s
+// has G of 1 and no softening, which is for the caller to set.
+func Binary(s goticles.Space) {
+	for _, x := range []float64{-0.5, 0.5} {
+		p := s.MkParticle(1).P()
+		p.Position = vect.V{x, 0}
+		p.Velocity = vect.V{0, math.Copysign(0.5, x)}
+	}
+}
+
+// OrbitError advances s, filled by Binary, through an orbit of count steps,
+// and returns the distance of its first particle from its starting point.
+func OrbitError(s goticles.Space, count int) float64 {
+	first := s.All()[0].Id
+	start := s.Particle(first).Position
+	for i := 0; i < count; i++ {
+		s.Step(Period / float64(count))
+	}
+	return s.Particle(first).Position.Dst(start)
+}
@@ -0,0 +1,20 @@
+package kepler
+
+import (
+	"github.com/niksaak/goticles/diagnostics"
+	"github.com/niksaak/goticles/rk4"
+	"testing"
+)
+
+func TestBinary(t *testing.T) {
+	space := rk4.New()
+	space.G, space.Softening = 1, 0
+	Binary(space)
+	r0 := diagnostics.MeasureSpace(space)
+	if err := OrbitError(space, 1000); err > 1e-6 {
+		t.Errorf("orbit missed its start by %v", err)
+	}
+	if drift := diagnostics.MeasureSpace(space).Drift(r0); drift > 1e-9 {
+		t.Errorf("energy drifted by %v", drift)
+	}
+}
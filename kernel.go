@@ -0,0 +1,108 @@
+package goticles
+
+import (
+	"fmt"
+	"math"
+)
+
+// The Kernel type selects how gravity is softened at distances comparable to
+// the softening length, to avoid the singularity of close encounters.
+type Kernel int
+
+const (
+	// CutoffKernel turns the interaction off entirely for particles closer
+	// than the softening length. The force is discontinuous at the cutoff.
+	CutoffKernel Kernel = iota
+	// PlummerKernel treats particles as Plummer spheres of softening length
+	// scale radius. The force is smooth, but differs from Newtonian at all
+	// distances.
+	PlummerKernel
+	// SplineKernel is the cubic spline kernel of Monaghan & Lattanzio, with
+	// the softening length as its support radius. The force is smooth and
+	// exactly Newtonian beyond the softening length.
+	SplineKernel
+)
+
+func (k Kernel) String() string {
+	switch k {
+	case CutoffKernel:
+		return "Cutoff"
+	case PlummerKernel:
+		return "Plummer"
+	case SplineKernel:
+		return "Spline"
+	default:
+		return fmt.Sprintf("Kernel(%d)", int(k))
+	}
+}
+
+// Factor returns the softened counterpart of 1/r³ for particles at squared
+// distance rSq with softening length eps, so that the acceleration of a
+// particle towards a body of mass m at separation d is G*m*Factor*d. Factor
+// is zero for coincident particles.
+func (k Kernel) Factor(rSq, eps float64) float64 {
+	if rSq == 0 {
+		return 0
+	}
+	switch k {
+	case CutoffKernel:
+		if rSq < eps*eps {
+			return 0
+		}
+	case PlummerKernel:
+		sSq := rSq + eps*eps
+		return 1 / (sSq * math.Sqrt(sSq))
+	case SplineKernel:
+		if rSq >= eps*eps {
+			break
+		}
+		r := math.Sqrt(rSq)
+		u := r / eps
+		h3 := eps * eps * eps
+		if u < 0.5 {
+			return (32.0/3 + u*u*(32*u-38.4)) / h3
+		}
+		return (64.0/3 - 48*u + 38.4*u*u - 32.0/3*u*u*u -
+			1.0/15/(u*u*u)) / h3
+	default:
+		panic(fmt.Errorf("Factor: bad kernel - %v", k))
+	}
+	return 1 / (rSq * math.Sqrt(rSq))
+}
+
+// Derivative returns the derivative of Factor with respect to rSq, so that
+// the rate of change of the acceleration G*m*Factor*d of a particle moving at
+// relative velocity v is G*m*(Factor*v + 2*Derivative*(d·v)*d). Derivative
+// is zero for coincident particles, and ignores the jump of CutoffKernel.
+func (k Kernel) Derivative(rSq, eps float64) float64 {
+	if rSq == 0 {
+		return 0
+	}
+	switch k {
+	case CutoffKernel:
+		if rSq < eps*eps {
+			return 0
+		}
+	case PlummerKernel:
+		sSq := rSq + eps*eps
+		return -1.5 / (sSq * sSq * math.Sqrt(sSq))
+	case SplineKernel:
+		if rSq >= eps*eps {
+			break
+		}
+		r := math.Sqrt(rSq)
+		u := r / eps
+		h3 := eps * eps * eps
+		// derivative with respect to u, and du/drSq = 1/(2*r*eps)
+		var df float64
+		if u < 0.5 {
+			df = u * (96*u - 76.8)
+		} else {
+			df = -48 + u*(76.8-32*u) + 0.2/(u*u*u*u)
+		}
+		return df / (2 * r * eps * h3)
+	default:
+		panic(fmt.Errorf("Derivative: bad kernel - %v", k))
+	}
+	return -1.5 / (rSq * rSq * math.Sqrt(rSq))
+}
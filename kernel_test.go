@@ -0,0 +1,40 @@
+package goticles
+
+import (
+	"math"
+	"testing"
+)
+
+func TestKernelNewtonianFarAway(t *testing.T) {
+	const EPS = 1e-2
+	const R = 1.0
+	for _, k := range []Kernel{CutoffKernel, PlummerKernel, SplineKernel} {
+		f := k.Factor(R*R, EPS)
+		if math.Abs(f-1/(R*R*R)) > 1e-3 {
+			t.Errorf("%v: factor at r = %v is %v", k, R, f)
+		}
+	}
+}
+
+func TestKernelContinuity(t *testing.T) {
+	const EPS = 1.0
+	const DR = 1e-6
+	for _, k := range []Kernel{PlummerKernel, SplineKernel} {
+		for _, r := range []float64{0.25, 0.5, 0.75, 1} {
+			f1 := k.Factor((r-DR)*(r-DR), EPS)
+			f2 := k.Factor((r+DR)*(r+DR), EPS)
+			if math.Abs(f1-f2) > 1e-4 {
+				t.Errorf("%v: factor jumps from %v to %v at r = %v",
+					k, f1, f2, r)
+			}
+		}
+	}
+}
+
+func TestKernelCoincident(t *testing.T) {
+	for _, k := range []Kernel{CutoffKernel, PlummerKernel, SplineKernel} {
+		if f := k.Factor(0, 0); f != 0 {
+			t.Errorf("%v: factor for coincident particles is %v", k, f)
+		}
+	}
+}
@@ -1,71 +1,245 @@
 package leapfrog
 
 import (
+	"fmt"
 	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/units"
 	"github.com/niksaak/goticles/vect"
+	"math"
+)
+
+// The Scheme type selects the order of leapfrog substeps.
+type Scheme int
+
+const (
+	// KDK is the kick-drift-kick scheme, also known as velocity Verlet. It
+	// reuses gravity computed at the end of the previous step unless
+	// particles or gravity have changed since; external forces and fields
+	// are applied afresh at every kick.
+	KDK Scheme = iota
+	// DKD is the drift-kick-drift scheme, also known as position Verlet.
+	DKD
+	// Block is the kick-drift-kick scheme with hierarchical block timesteps.
+	// Each particle steps by a power-of-two fraction dt/2ᴸ of the step, its
+	// level L chosen from its acceleration a as the smallest one with
+	// dt/2ᴸ ≤ sqrt(2*Eta*Softening/|a|), up to MaxLevel. Only particles
+	// ending their step have their forces computed, and all of them are
+	// synchronised at the end of the step. The criterion needs softening,
+	// and Step panics without it.
+	Block
 )
 
 const (
-	G           = 6.67384e-11
-	TRESHOLD    = 2e-3
-	TRESHOLD_SQ = TRESHOLD * TRESHOLD
+	ETA       = 0.025 // default accuracy parameter of Block timesteps
+	MAX_LEVEL = 10    // default deepest level of Block timesteps
 )
 
+func (s Scheme) String() string {
+	switch s {
+	case KDK:
+		return "KDK"
+	case DKD:
+		return "DKD"
+	case Block:
+		return "Block"
+	default:
+		return fmt.Sprintf("Scheme(%d)", int(s))
+	}
+}
+
 type Space struct {
-	time      float64
-	Particles []goticles.P
+	units.Base
+	Scheme      Scheme
+	Eta         float64 // accuracy parameter of Block timesteps
+	MaxLevel    int     // deepest level of Block timesteps, at most 62
+	Workers     int     // goroutines computing forces, see goticles.Workers
+	gravities   []vect.V
+	fieldAccel  []vect.V
+	accelerated bool    // whether gravities are up to date
+	levels      []int   // of particles in Block steps
+	ends        []int64 // ticks at which steps of particles end
+	active      []int   // particles ending their step at the current tick
+	// particles as they were at the end of the last step
+	snapshot goticles.Snapshot
 }
 
+var _ units.Space = &Space{}
+
 func New() *Space {
-	return new(Space)
+	return &Space{
+		Base:     units.NewBase(),
+		Eta:      ETA,
+		MaxLevel: MAX_LEVEL,
+	}
 }
 
-func (s *Space) Particle(id int) *goticles.P {
-	if id >= len(s.Particles) {
-		return nil
+// accelerate computes the total acceleration of every particle, storing it in
+// its Acceleration. Gravity is only computed if it is not up to date, while
+// external forces and fields, which may have changed, always are.
+func (s *Space) accelerate() {
+	ln := len(s.Particles)
+	if len(s.gravities) != ln {
+		s.gravities = make([]vect.V, ln)
+		s.fieldAccel = make([]vect.V, ln)
+		s.accelerated = false
+	}
+	if !s.accelerated {
+		goticles.Parallel(s.Workers, ln, func(lo, hi int) {
+			for i := lo; i < hi; i++ {
+				s.gravities[i] = s.Accel(s.Particles, i)
+			}
+		})
+		s.accelerated = true
+	}
+	for i := range s.Particles {
+		s.fieldAccel[i] = vect.V{}
+	}
+	s.Fields.Accelerate(s.Particles, s.fieldAccel)
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Acceleration = s.gravities[i].Add(
+			p.ExternalAcceleration()).Add(s.fieldAccel[i])
 	}
-	return &s.Particles[id]
 }
 
-func (s *Space) MkParticle(mass float64) *goticles.P {
-	id := len(s.Particles)
-	s.Particles = append(s.Particles, goticles.P{
-		Id:   id,
-		Mass: mass,
+// accelerateActive computes the total acceleration of particles in s.active,
+// storing it in their Acceleration. Fields are applied to all particles, as
+// they may act between them.
+func (s *Space) accelerateActive() {
+	goticles.Parallel(s.Workers, len(s.active), func(lo, hi int) {
+		for _, i := range s.active[lo:hi] {
+			s.gravities[i] = s.Accel(s.Particles, i)
+		}
 	})
-	return &s.Particles[id]
+	if len(s.Fields) != 0 {
+		for i := range s.Particles {
+			s.fieldAccel[i] = vect.V{}
+		}
+		s.Fields.Accelerate(s.Particles, s.fieldAccel)
+	}
+	for _, i := range s.active {
+		p := &s.Particles[i]
+		p.Acceleration = s.gravities[i].Add(p.ExternalAcceleration())
+		if len(s.Fields) != 0 {
+			p.Acceleration = p.Acceleration.Add(s.fieldAccel[i])
+		}
+	}
 }
 
-func (s *Space) RmParticle(id int) {
-	// TODO
+func (s *Space) kick(dt float64) {
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Velocity = p.Velocity.Add(p.Acceleration.Mul(dt))
+	}
 }
 
-func force(p, q *goticles.P) vect.V {
-	distV := p.Position.Sub(q.Position)
-	distSq := distV.LenSq()
-	if distSq < TRESHOLD_SQ {
-		return vect.V{}
-	}
-	distU := distV.Ulen()
-	return distU.Mul(G * p.Mass * q.Mass / distSq).Neg()
+func (s *Space) drift(dt float64) {
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Position = p.Position.Add(p.Velocity.Mul(dt))
+	}
+	s.accelerated = false
 }
 
-func particleLeapfrog(p *goticles.P, force vect.V, dt float64) {
-	p.Position = p.Position.Add(p.Velocity.Mul(dt)).Add(
-		p.Acceleration.Mul(dt * dt).Mul(0.5))
-	p.Velocity = p.Velocity.Add(p.Acceleration.Add(force).Mul(0.5).Mul(dt))
-	p.Acceleration = force
+// level returns the Block level of particle i for a step of dt, at tick now
+// of the step divided into ticks. Particles move to coarser levels only at
+// ticks where steps of the level begin.
+func (s *Space) level(i int, dt float64, now, ticks int64) int {
+	limit := math.Sqrt(2 * s.Eta * s.Softening /
+		s.Particles[i].Acceleration.Len())
+	level := 0
+	for level < s.MaxLevel && dt/float64(int64(1)<<uint(level)) > limit {
+		level++
+	}
+	for level < s.MaxLevel && now%(ticks>>uint(level)) != 0 {
+		level++
+	}
+	return level
 }
 
-func (s *Space) Step(dt float64) {
+// block advances the simulation by dt with Block timesteps. Accelerations
+// have to be up to date; gravities are again at the end.
+func (s *Space) block(dt float64) {
+	if s.MaxLevel < 0 || s.MaxLevel > 62 {
+		panic(fmt.Errorf("Step: bad max level - %v", s.MaxLevel))
+	}
+	if !(s.Softening > 0) {
+		panic(fmt.Errorf("Step: Block timesteps need softening - %v",
+			s.Softening))
+	}
 	ln := len(s.Particles)
+	if len(s.levels) != ln {
+		s.levels = make([]int, ln)
+		s.ends = make([]int64, ln)
+	}
+	ticks := int64(1) << uint(s.MaxLevel)
+	tick := dt / float64(ticks)
 	for i := range s.Particles {
 		p := &s.Particles[i]
-		for j := i + 1; j < ln; j++ {
-			q := &s.Particles[j]
-			pqForce := force(p, q)
-			particleLeapfrog(p, pqForce, dt)
-			particleLeapfrog(q, pqForce.Neg(), dt)
+		s.levels[i] = s.level(i, dt, 0, ticks)
+		s.ends[i] = ticks >> uint(s.levels[i])
+		p.Velocity = p.Velocity.Add(
+			p.Acceleration.Mul(float64(s.ends[i]) * tick / 2))
+	}
+	for now := int64(0); now < ticks; {
+		next := ticks
+		for _, end := range s.ends {
+			if end < next {
+				next = end
+			}
+		}
+		s.drift(float64(next-now) * tick)
+		now = next
+		s.active = s.active[:0]
+		for i, end := range s.ends {
+			if end == now {
+				s.active = append(s.active, i)
+			}
+		}
+		s.accelerateActive()
+		for _, i := range s.active {
+			p := &s.Particles[i]
+			span := ticks >> uint(s.levels[i])
+			p.Velocity = p.Velocity.Add(
+				p.Acceleration.Mul(float64(span) * tick / 2))
+			if now == ticks {
+				continue
+			}
+			s.levels[i] = s.level(i, dt, now, ticks)
+			span = ticks >> uint(s.levels[i])
+			s.ends[i] = now + span
+			p.Velocity = p.Velocity.Add(
+				p.Acceleration.Mul(float64(span) * tick / 2))
 		}
 	}
+	// all particles were active at the last tick
+	s.accelerated = true
+}
+
+// Step advances the simulation by dt, evaluating forces once, or as often as
+// Block timesteps need.
+func (s *Space) Step(dt float64) {
+	if !s.snapshot.Holds(&s.Gravity, s.Particles) {
+		s.accelerated = false
+	}
+	switch s.Scheme {
+	case KDK:
+		s.accelerate()
+		s.kick(dt / 2)
+		s.drift(dt)
+		s.accelerate()
+		s.kick(dt / 2)
+	case DKD:
+		s.drift(dt / 2)
+		s.accelerate()
+		s.kick(dt)
+		s.drift(dt / 2)
+	case Block:
+		s.accelerate()
+		s.block(dt)
+	default:
+		panic(fmt.Errorf("Step: bad scheme - %v", s.Scheme))
+	}
+	s.snapshot.Take(&s.Gravity, s.Particles)
+	s.Advance(dt)
 }
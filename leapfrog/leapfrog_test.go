@@ -1,7 +1,12 @@
 package leapfrog
 
 import (
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/diagnostics"
+	"github.com/niksaak/goticles/rk4"
+	"github.com/niksaak/goticles/units"
 	"github.com/niksaak/goticles/vect"
+	"math"
 	"math/rand"
 	"testing"
 )
@@ -17,17 +22,16 @@ func uRandVect() vect.V {
 func makeSpace(particleCount int) *Space {
 	s := New()
 	for i := 0; i < particleCount; i++ {
-		p := s.MkParticle(1)
+		p := s.MkParticle(1).P()
 		p.Position = uRandVect()
 	}
 	return s
 }
 
-/*
 func TestOneBodyIntegration(t *testing.T) {
 	const dt = 1.0/10.0
 	space := New()
-	particle := space.MkParticle(1)
+	particle := space.MkParticle(1).P()
 	particle.Velocity = vect.V{1, 0}
 	position := particle.Position
 	t.Logf("t: 0.00, position: %v", particle.Position)
@@ -42,7 +46,6 @@ func TestOneBodyIntegration(t *testing.T) {
 			position, newPosition, 1.0 / dt)
 	}
 }
-*/
 
 func TestTwoBodiesIntegration(t *testing.T) {
 	const dt = 1.0/10.0
@@ -59,6 +62,139 @@ func TestTwoBodiesIntegration(t *testing.T) {
 	}
 }
 
+// binary returns a space with two unit masses on a circular orbit of period
+// 2π around the origin, with G = 1.
+func binary() *Space {
+	space := New()
+	space.G = 1
+	for _, x := range []float64{-0.5, 0.5} {
+		p := space.MkParticle(1).P()
+		p.Position = vect.V{x, 0}
+		p.Velocity = vect.V{0, math.Copysign(math.Sqrt(0.5), x)}
+	}
+	return space
+}
+
+func TestSchemes(t *testing.T) {
+	const dt = 2 * math.Pi / 1000
+	for _, scheme := range []Scheme{KDK, DKD} {
+		space := binary()
+		space.Scheme = scheme
+		reference := rk4.New()
+		reference.G = 1
+		for _, p := range space.All() {
+			q := reference.MkParticle(p.Mass).P()
+			q.Position, q.Velocity = p.Position, p.Velocity
+		}
+		r0 := diagnostics.MeasureSpace(space)
+		maxDrift := 0.0
+		for i := 0; i < 1000; i++ {
+			space.Step(dt)
+			reference.Step(dt)
+			drift := diagnostics.MeasureSpace(space).Drift(r0)
+			maxDrift = math.Max(maxDrift, drift)
+		}
+		if maxDrift > 1e-4 {
+			t.Errorf("%v: energy drifted by %v", scheme, maxDrift)
+		}
+		for id := 0; id < 2; id++ {
+			p, q := space.Particle(id), reference.Particle(id)
+			if d := p.Position.Dst(q.Position); d > 1e-3 {
+				t.Errorf("%v: particle %d is %v away from rk4's", scheme, id, d)
+			}
+		}
+	}
+}
+
+func TestExternalForce(t *testing.T) {
+	const dt = 1.0 / 10.0
+	space := New()
+	p := space.MkParticle(2)
+	p.P().Force = vect.V{1, 0}
+	for i := 0; i < 10; i++ {
+		space.Step(dt)
+	}
+	if v := p.P().Velocity; math.Abs(v.X-0.5) > 1e-9 || v.Y != 0 {
+		t.Errorf("velocity is not {0.5 0} but %v", v)
+	}
+	if f := p.P().Force; !f.Eql(vect.V{1, 0}) {
+		t.Errorf("force did not persist: %v", f)
+	}
+}
+
+func TestSchemeChange(t *testing.T) {
+	const dt = 2 * math.Pi / 100
+	// DKD leaves accelerations of its midpoint behind, which KDK must not
+	// take for those at the end of the step
+	space, reference := binary(), binary()
+	space.Scheme = DKD
+	space.Step(dt)
+	space.Scheme = KDK
+	for i := range reference.Particles {
+		reference.Particles[i].Position = space.Particles[i].Position
+		reference.Particles[i].Velocity = space.Particles[i].Velocity
+	}
+	space.Step(dt)
+	reference.Step(dt)
+	for id := 0; id < 2; id++ {
+		p, q := space.Particle(id), reference.Particle(id)
+		if !p.Position.Eql(q.Position) || !p.Velocity.Eql(q.Velocity) {
+			t.Errorf("particle %d is %v, not %v", id, *p, *q)
+		}
+	}
+}
+
+func TestFields(t *testing.T) {
+	const dt = 1.0 / 10.0
+	space := New()
+	space.Fields = goticles.Fields{goticles.Uniform{0, -1}}
+	p := space.MkParticle(1)
+	for i := 0; i < 10; i++ {
+		space.Step(dt)
+	}
+	if v := p.P().Velocity; math.Abs(v.Y+1) > 1e-9 || v.X != 0 {
+		t.Errorf("velocity is not {0 -1} but %v", v)
+	}
+}
+
+// randomSpace returns a Space in N-body units with count particles of unit
+// mass, placed reproducibly.
+func randomSpace(count int) *Space {
+	rnd := rand.New(rand.NewSource(1))
+	space := New()
+	space.SetUnits(units.NBody(float64(count), 1))
+	for i := 0; i < count; i++ {
+		p := space.MkParticle(1).P()
+		p.Position = vect.V{rnd.Float64() - 0.5, rnd.Float64() - 0.5}
+	}
+	return space
+}
+
+func TestWorkers(t *testing.T) {
+	const COUNT = 100
+	const STEP = 1.0 / 100
+	run := func(workers int) *Space {
+		space := randomSpace(COUNT)
+		space.Workers = workers
+		for i := 0; i < 10; i++ {
+			space.Step(STEP)
+		}
+		return space
+	}
+	reference := run(1)
+	for _, workers := range []int{2, 3, 8} {
+		space := run(workers)
+		for i, p := range space.Particles {
+			q := reference.Particles[i]
+			if !p.Position.Eql(q.Position) || !p.Velocity.Eql(q.Velocity) {
+				t.Errorf("%d workers: particle %d is %v, not %v",
+					workers, i, p, q)
+				break
+			}
+		}
+	}
+}
+
 func BenchmarkSimulation2(b *testing.B) {
 	const dt = 1.0/100
 	space := makeSpace(2)
@@ -94,3 +230,94 @@ func BenchmarkSimulation1024(b *testing.B) {
 		space.Step(dt)
 	}
 }
+
+func TestBlockSingleLevel(t *testing.T) {
+	const COUNT = 100
+	const STEP = 1.0 / 100
+	reference := randomSpace(COUNT)
+	space := randomSpace(COUNT)
+	space.Scheme = Block
+	space.MaxLevel = 0
+	for i := 0; i < 10; i++ {
+		reference.Step(STEP)
+		space.Step(STEP)
+	}
+	for i, p := range space.Particles {
+		q := reference.Particles[i]
+		if !p.Position.Eql(q.Position) || !p.Velocity.Eql(q.Velocity) {
+			t.Errorf("particle %d is %v, not %v as with KDK", i, p, q)
+			break
+		}
+	}
+}
+
+// hierarchy returns a space with a hard binary of unit masses at separation
+// 0.01 around the origin, and a light particle orbiting it at distance 10,
+// with G = 1 and Plummer softening.
+func hierarchy(scheme Scheme) *Space {
+	space := New()
+	space.G = 1
+	space.Softening = 1e-3
+	space.Kernel = goticles.PlummerKernel
+	space.Scheme = scheme
+	space.MaxLevel = 16
+	v := math.Sqrt(0.5 / 0.01)
+	for _, x := range []float64{-0.005, 0.005} {
+		p := space.MkParticle(1).P()
+		p.Position = vect.V{x, 0}
+		p.Velocity = vect.V{0, math.Copysign(v/2, x)}
+	}
+	p := space.MkParticle(1e-3).P()
+	p.Position = vect.V{10, 0}
+	p.Velocity = vect.V{0, math.Sqrt(2.0 / 10)}
+	return space
+}
+
+func TestBlock(t *testing.T) {
+	const STEP = 0.1
+	const STEPS = 10
+	const LEVEL = 13 // of the binary
+	space := hierarchy(Block)
+	space.Eta = ETA / 16
+	reference := hierarchy(KDK)
+	r0 := diagnostics.MeasureSpace(space)
+	for i := 0; i < STEPS; i++ {
+		space.Step(STEP)
+		for j := 0; j < 1<<LEVEL; j++ {
+			reference.Step(STEP / (1 << LEVEL))
+		}
+	}
+	levels := space.levels
+	if levels[0] != LEVEL || levels[1] != LEVEL || levels[2] > LEVEL-8 {
+		t.Errorf("levels are %v, not %d for the binary and much lower for "+
+			"the light particle", levels, LEVEL)
+	}
+	if math.Abs(space.Time()-STEP*STEPS) > 1e-12 {
+		t.Errorf("time is %v, not %v", space.Time(), STEP*STEPS)
+	}
+	// the binary changes levels along its orbit, so only the light particle
+	// keeps close to global steps
+	p, q := space.Particle(2), reference.Particle(2)
+	if d := p.Position.Dst(q.Position); d > 1e-6 {
+		t.Errorf("light particle is %v away from global steps", d)
+	}
+	drift := diagnostics.MeasureSpace(space).Drift(r0)
+	referenceDrift := diagnostics.MeasureSpace(reference).Drift(r0)
+	t.Logf("energy drift %.3g, %.3g with global steps", drift, referenceDrift)
+	if drift > 1.1*referenceDrift {
+		t.Errorf("energy drifted by %v, %v with global steps",
+			drift, referenceDrift)
+	}
+}
+
+func TestBlockSoftening(t *testing.T) {
+	// without softening, the criterion would send all particles to MaxLevel
+	space := hierarchy(Block)
+	space.Softening = 0
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Block step without softening did not panic")
+		}
+	}()
+	space.Step(0.1)
+}
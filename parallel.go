@@ -0,0 +1,38 @@
+package goticles
+
+import (
+	"runtime"
+	"sync"
+)
+
+// Workers returns the number of goroutines to use when n are requested: n
+// itself if positive, or GOMAXPROCS otherwise.
+func Workers(n int) int {
+	if n > 0 {
+		return n
+	}
+	return runtime.GOMAXPROCS(0)
+}
+
+// Parallel splits the range from 0 to n into contiguous chunks, calls body
+// for each of them on up to Workers(workers) goroutines, and waits for all of
+// them to return. Body is called directly when there is a single chunk.
+func Parallel(workers, n int, body func(lo, hi int)) {
+	workers = Workers(workers)
+	if workers > n {
+		workers = n
+	}
+	if workers <= 1 {
+		body(0, n)
+		return
+	}
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func(lo, hi int) {
+			body(lo, hi)
+			wg.Done()
+		}(n*w/workers, n*(w+1)/workers)
+	}
+	wg.Wait()
+}
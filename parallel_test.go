@@ -0,0 +1,26 @@
+package goticles
+
+import "testing"
+
+func TestParallel(t *testing.T) {
+	const COUNT = 1000
+	for _, workers := range []int{0, 1, 2, 3, 8, COUNT + 1} {
+		var visits [COUNT]int
+		Parallel(workers, COUNT, func(lo, hi int) {
+			for i := lo; i < hi; i++ {
+				visits[i]++
+			}
+		})
+		for i, v := range visits {
+			if v != 1 {
+				t.Errorf("%d workers: %d visited %d times", workers, i, v)
+				break
+			}
+		}
+	}
+	Parallel(4, 0, func(lo, hi int) {
+		if lo != hi {
+			t.Errorf("empty range split into %d to %d", lo, hi)
+		}
+	})
+}
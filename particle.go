@@ -5,11 +5,24 @@ import (
 )
 
 // The P type describes a Particle to be used in particle simulations.
+//
+// Force is an external force applied to the particle in addition to the
+// forces the Space computes. Spaces never reset it, so it keeps acting on
+// every step until it is changed.
 type P struct {
-	Id       int
-	Position vect.V
-	Velocity vect.V
+	Id           int
+	Position     vect.V
+	Velocity     vect.V
 	Acceleration vect.V
-	Force    vect.V
-	Mass     float64
+	Force        vect.V
+	Mass         float64
+}
+
+// ExternalAcceleration returns the acceleration caused by p.Force. Massless
+// particles are not affected by external forces.
+func (p *P) ExternalAcceleration() vect.V {
+	if p.Mass == 0 {
+		return vect.V{}
+	}
+	return p.Force.Div(p.Mass)
 }
@@ -1,3 +0,0 @@
-package rk4
-
-const G = 6.67384e-11
@@ -0,0 +1,135 @@
+package rk4
+
+import "fmt"
+
+// The Method type selects the explicit Runge-Kutta method making a step.
+type Method int
+
+const (
+	// RK4 is the classic fourth order method.
+	RK4 Method = iota
+	// ThreeEighths is the fourth order 3/8 rule of Kutta, an alternative to
+	// RK4 with as many stages.
+	ThreeEighths
+	// Heun is the second order explicit trapezoidal rule, with Euler's
+	// method embedded.
+	Heun
+	// RK3 is the third order method of Kutta.
+	RK3
+	// Fehlberg is the fourth order method of Fehlberg with an embedded fifth
+	// order solution, taking six stages.
+	Fehlberg
+	// DormandPrince is the fifth order method of Dormand & Prince with an
+	// embedded fourth order solution, taking six stages, and a seventh for
+	// the embedded solution.
+	DormandPrince
+)
+
+func (m Method) String() string {
+	switch m {
+	case RK4:
+		return "RK4"
+	case ThreeEighths:
+		return "ThreeEighths"
+	case Heun:
+		return "Heun"
+	case RK3:
+		return "RK3"
+	case Fehlberg:
+		return "Fehlberg"
+	case DormandPrince:
+		return "DormandPrince"
+	default:
+		return fmt.Sprintf("Method(%d)", int(m))
+	}
+}
+
+// The tableau type is the Butcher tableau of an explicit method. Stage k is
+// evaluated from the initial state advanced with derivatives of earlier
+// stages weighted by a[k]; the step advances the state with derivatives of
+// stages weighted by b. Embedded weights bHat give a
+// solution of order embedded, whose difference estimates the error; stages
+// past the end of b only serve that solution.
+type tableau struct {
+	order    int
+	embedded int
+	a        [][]float64
+	b        []float64
+	bHat     []float64
+}
+
+var tableaux = [...]tableau{
+	RK4: {
+		order: 4,
+		a: [][]float64{
+			{},
+			{1.0 / 2},
+			{0, 1.0 / 2},
+			{0, 0, 1},
+		},
+		b: []float64{1.0 / 6, 1.0 / 3, 1.0 / 3, 1.0 / 6},
+	},
+	ThreeEighths: {
+		order: 4,
+		a: [][]float64{
+			{},
+			{1.0 / 3},
+			{-1.0 / 3, 1},
+			{1, -1, 1},
+		},
+		b: []float64{1.0 / 8, 3.0 / 8, 3.0 / 8, 1.0 / 8},
+	},
+	Heun: {
+		order:    2,
+		embedded: 1,
+		a: [][]float64{
+			{},
+			{1},
+		},
+		b:    []float64{1.0 / 2, 1.0 / 2},
+		bHat: []float64{1, 0},
+	},
+	RK3: {
+		order: 3,
+		a: [][]float64{
+			{},
+			{1.0 / 2},
+			{-1, 2},
+		},
+		b: []float64{1.0 / 6, 2.0 / 3, 1.0 / 6},
+	},
+	Fehlberg: {
+		order:    4,
+		embedded: 5,
+		a: [][]float64{
+			{},
+			{1.0 / 4},
+			{3.0 / 32, 9.0 / 32},
+			{1932.0 / 2197, -7200.0 / 2197, 7296.0 / 2197},
+			{439.0 / 216, -8, 3680.0 / 513, -845.0 / 4104},
+			{-8.0 / 27, 2, -3544.0 / 2565, 1859.0 / 4104, -11.0 / 40},
+		},
+		b: []float64{25.0 / 216, 0, 1408.0 / 2565, 2197.0 / 4104, -1.0 / 5},
+		bHat: []float64{16.0 / 135, 0, 6656.0 / 12825, 28561.0 / 56430,
+			-9.0 / 50, 2.0 / 55},
+	},
+	DormandPrince: {
+		order:    5,
+		embedded: 4,
+		a: [][]float64{
+			{},
+			{1.0 / 5},
+			{3.0 / 40, 9.0 / 40},
+			{44.0 / 45, -56.0 / 15, 32.0 / 9},
+			{19372.0 / 6561, -25360.0 / 2187, 64448.0 / 6561, -212.0 / 729},
+			{9017.0 / 3168, -355.0 / 33, 46732.0 / 5247, 49.0 / 176,
+				-5103.0 / 18656},
+			{35.0 / 384, 0, 500.0 / 1113, 125.0 / 192, -2187.0 / 6784,
+				11.0 / 84},
+		},
+		b: []float64{35.0 / 384, 0, 500.0 / 1113, 125.0 / 192,
+			-2187.0 / 6784, 11.0 / 84},
+		bHat: []float64{5179.0 / 57600, 0, 7571.0 / 16695, 393.0 / 640,
+			-92097.0 / 339200, 187.0 / 2100, 1.0 / 40},
+	},
+}
@@ -1,117 +1,255 @@
 package rk4
 
 import (
+	"fmt"
 	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/units"
 	"github.com/niksaak/goticles/vect"
 	"math"
 )
 
 type Space struct {
-	Time       float64
-	Particles  []goticles.P
-	positions  [][4]vect.V
-	velocities [][4]vect.V
-	masses     []float64
+	units.Base
+	Method Method
+	// Tolerance is the relative error allowed per substep when positive,
+	// making Step split its time into substeps chosen from the error estimate
+	// of the method's embedded solution. Only Heun, Fehlberg and
+	// DormandPrince have one; Step panics with other methods. When it is
+	// zero, each Step is taken at once.
+	Tolerance     float64
+	Workers       int        // goroutines computing forces, see goticles.Workers
+	positions     [][]vect.V // by stage, then particle
+	velocities    [][]vect.V
+	accelerations [][]vect.V
+	stage         []goticles.P
+	fieldAccel    []vect.V
+	next          float64 // substep suggested for the next Step
+	substeps      int
 }
 
+var _ units.Space = &Space{}
+
 func New() *Space {
-	return new(Space)
+	return &Space{Base: units.NewBase()}
 }
 
-func (s *Space) Particle(id int) *goticles.P {
-	return &s.Particles[id]
+// SetUnits switches the Space to unit system u. The substep suggested for the
+// next Step, which is in the old units, is forgotten.
+func (s *Space) SetUnits(u units.System) {
+	s.Base.SetUnits(u)
+	s.next = 0
 }
 
-func (s *Space) MkParticle(mass float64) *goticles.P {
-	id := len(s.Particles)
-	s.Particles = append(s.Particles, goticles.P{
-		Id:   id,
-		Mass: mass,
-	})
-	s.positions = append(s.positions, [4]vect.V{})
-	s.velocities = append(s.velocities, [4]vect.V{})
-	return &s.Particles[id]
+// Substeps returns the number of substeps taken by the last Step.
+func (s *Space) Substeps() int {
+	return s.substeps
 }
 
+// Step advances the simulation by dt with s.Method, in substeps when
+// s.Tolerance is positive. Adaptive steps need a method with an embedded
+// solution, which are Heun, Fehlberg and DormandPrince.
 func (s *Space) Step(dt float64) {
-	s.evaluate1()
-	s.evaluateK(dt/2, 1)
-	s.evaluateK(dt/2, 2)
-	s.evaluateK(dt, 3)
-	s.applyState(dt)
-	s.Time += dt
+	if s.Method < 0 || int(s.Method) >= len(tableaux) {
+		panic(fmt.Errorf("Step: bad method - %v", s.Method))
+	}
+	t := &tableaux[s.Method]
+	s.evaluate1(len(t.a))
+	if s.Tolerance > 0 {
+		s.adapt(dt, t)
+	} else {
+		// stages past the end of b don't contribute to the step
+		s.evaluateStages(dt, t.a[:len(t.b)])
+		s.applyState(dt, t.b)
+		s.substeps = 1
+	}
+	s.Advance(dt)
 }
 
-func (s *Space) evaluate1() {
-	particleCount := len(s.Particles)
+const (
+	SAFETY      = 0.9  // fraction of the substep expected to meet Tolerance
+	MIN_SCALE   = 0.2  // smallest factor a substep shrinks by
+	MAX_SCALE   = 5    // largest factor a substep grows by
+	MIN_SUBSTEP = 1e-6 // fraction of the step below which errors are accepted
+	ERROR_FLOOR = 1e-3 // fraction of the largest change errors are relative to
+)
 
-	// check integration arrays size
-	if len(s.positions) != particleCount {
-		s.positions = make([][4]vect.V, particleCount)
+// adapt advances the simulation by dt in substeps meeting s.Tolerance with
+// method t, starting from the initial state of the first one. Substeps of
+// MIN_SUBSTEP of dt are taken whatever their error, so that forces jumping
+// discontinuously, as with CutoffKernel, don't stall the step.
+func (s *Space) adapt(dt float64, t *tableau) {
+	if t.bHat == nil {
+		panic(fmt.Errorf("Step: method without error estimate - %v",
+			s.Method))
 	}
-	if len(s.velocities) != particleCount {
-		s.velocities = make([][4]vect.V, particleCount)
+	exponent := -1 / (math.Min(float64(t.order), float64(t.embedded)) + 1)
+	minimum := MIN_SUBSTEP * math.Abs(dt)
+	h := s.next
+	if !(h*dt > 0) {
+		h = dt
 	}
-	if len(s.masses) != particleCount {
-		s.masses = make([]float64, particleCount)
+	s.substeps = 0
+	for left := dt; ; {
+		h = goticles.Substep(left, h)
+		h0 := h
+		s.evaluateStages(h0, t.a)
+		err := s.stepError(t) / s.Tolerance
+		scale := math.Max(MIN_SCALE,
+			math.Min(MAX_SCALE, SAFETY*math.Pow(err, exponent)))
+		rejected := err > 1 && math.Abs(h) > minimum
+		h = math.Copysign(math.Max(math.Abs(h*scale), minimum), dt)
+		if rejected {
+			continue
+		}
+		s.applyState(h0, t.b)
+		s.substeps++
+		if h0 == left {
+			s.next = h
+			return
+		}
+		left -= h0
+		s.evaluate1(len(t.a))
 	}
+}
 
-	// get state
-	for i, p := range s.Particles {
-		s.positions[i][0] = p.Position
-		s.velocities[i][0] = p.Velocity
-		s.masses[i] = p.Mass
+// stepError returns the largest error estimate of the last substep with
+// method t, relative to the change of position or velocity of a particle.
+// Changes under ERROR_FLOOR of the largest one count as that much instead, so
+// that particles barely moving, whose relative errors are mostly rounding,
+// don't hold the substep back.
+func (s *Space) stepError(t *tableau) float64 {
+	var err float64
+	for _, derivs := range [2][][]vect.V{s.velocities, s.accelerations} {
+		floor := 0.0
+		for i := range s.stage {
+			change := weightedSum(1, t.b, derivs, i).Len()
+			floor = math.Max(floor, ERROR_FLOOR*change)
+		}
+		for i := range s.stage {
+			change := weightedSum(1, t.b, derivs, i)
+			diff := change.Sub(weightedSum(1, t.bHat, derivs, i)).Len()
+			if diff != 0 {
+				err = math.Max(err, diff/math.Max(change.Len(), floor))
+			}
+		}
 	}
+	return err
 }
 
-func (s *Space) evaluateK(dt float64, k int) {
-	for i := range s.positions {
-		position := &s.positions[i][k]
-		position.X = s.positions[i][0].X + s.velocities[i][k-1].X*dt
-		position.Y = s.positions[i][0].Y + s.velocities[i][k-1].Y*dt
-
-		s.velocities[i][k] = s.velocities[i][0]
+// evaluateStages computes states of stages past the first, advanced by dt
+// from the initial state with the derivatives of earlier stages weighted by
+// rows of a.
+func (s *Space) evaluateStages(dt float64, a [][]float64) {
+	for k := 1; k < len(a); k++ {
+		s.evaluateK(dt, a[k], k)
 	}
-	for i := range s.positions {
-		position := &s.positions[i][k]
-		m1 := s.masses[i]
-		for j := i + 1; j < len(s.positions); j++ {
-			m2 := s.masses[j]
+}
 
-			dx := position.X - s.positions[j][k].X
-			dy := position.Y - s.positions[j][k].Y
-			if dx == 0 && dy == 0 {
-				continue
-			}
+// evaluate1 computes the initial state, making room for stages.
+func (s *Space) evaluate1(stages int) {
+	particleCount := len(s.Particles)
 
-			dSquared := dx*dx + dy*dy
-			distance := math.Sqrt(dSquared)
-			mag := dSquared + distance*0
+	// check integration arrays size
+	if len(s.stage) != particleCount || len(s.positions) < stages {
+		s.positions = resize(s.positions, stages, particleCount)
+		s.velocities = resize(s.velocities, stages, particleCount)
+		s.accelerations = resize(s.accelerations, stages, particleCount)
+		s.stage = make([]goticles.P, particleCount)
+		s.fieldAccel = make([]vect.V, particleCount)
+	}
 
-			fX := G * m1 * m2 * dx / mag
-			fY := G * m1 * m2 * dy / mag
+	// get state
+	for i, p := range s.Particles {
+		s.positions[0][i] = p.Position
+		s.velocities[0][i] = p.Velocity
+		s.stage[i] = p
+	}
+	s.accelerate(0)
+}
+
+// resize returns arrays for at least stages stages of count particles,
+// reusing vs.
+func resize(vs [][]vect.V, stages, count int) [][]vect.V {
+	for len(vs) < stages {
+		vs = append(vs, nil)
+	}
+	for k := range vs {
+		if len(vs[k]) != count {
+			vs[k] = make([]vect.V, count)
+		}
+	}
+	return vs
+}
 
-			s.velocities[i][k].X -= fX * dt
-			s.velocities[i][k].Y -= fY * dt
+// evaluateK computes the state of stage k, advanced by dt from the initial
+// state with the derivatives of earlier stages weighted by a.
+func (s *Space) evaluateK(dt float64, a []float64, k int) {
+	for i := range s.stage {
+		position := s.positions[0][i]
+		velocity := s.velocities[0][i]
+		for l, w := range a {
+			if w != 0 {
+				position = position.Add(s.velocities[l][i].Mul(w * dt))
+				velocity = velocity.Add(s.accelerations[l][i].Mul(w * dt))
+			}
+		}
+		s.positions[k][i] = position
+		s.velocities[k][i] = velocity
+	}
+	s.accelerate(k)
+}
 
-			s.velocities[j][k].X += fX * dt
-			s.velocities[j][k].Y += fY * dt
+// accelerate computes the accelerations of particles in the state of stage k,
+// which it copies to s.stage.
+func (s *Space) accelerate(k int) {
+	for i := range s.stage {
+		s.stage[i].Position = s.positions[k][i]
+		s.stage[i].Velocity = s.velocities[k][i]
+	}
+	accelerations := s.accelerations[k]
+	goticles.Parallel(s.Workers, len(s.stage), func(lo, hi int) {
+		for i := lo; i < hi; i++ {
+			accelerations[i] = s.stage[i].ExternalAcceleration().Add(
+				s.Accel(s.stage, i))
 		}
+	})
+	s.accelerateFields(k)
+}
+
+// accelerateFields adds the acceleration due to s.Fields at stage k, whose
+// state is in s.stage.
+func (s *Space) accelerateFields(k int) {
+	if len(s.Fields) == 0 {
+		return
+	}
+	for i := range s.stage {
+		s.fieldAccel[i] = vect.V{}
+	}
+	s.Fields.Accelerate(s.stage, s.fieldAccel)
+	for i := range s.stage {
+		s.accelerations[k][i] = s.accelerations[k][i].Add(s.fieldAccel[i])
 	}
 }
 
-func (s *Space) applyState(dt float64) {
+// applyState advances particles by dt with the derivatives of stages weighted
+// by b.
+func (s *Space) applyState(dt float64, b []float64) {
 	for i := range s.Particles {
 		p := &s.Particles[i]
-		p.Position = rk4Mean(dt, s.positions[i])
-		p.Velocity = rk4Mean(dt, s.velocities[i])
+		p.Position = p.Position.Add(weightedSum(dt, b, s.velocities, i))
+		p.Velocity = p.Velocity.Add(weightedSum(dt, b, s.accelerations, i))
+		p.Acceleration = s.accelerations[0][i]
 	}
 }
 
-func rk4Mean(dt float64, vec [4]vect.V) vect.V {
-	const FRAC = 1.0 / 6.0
-	return vect.V{
-		X: FRAC * (vec[0].X + 2*(vec[1].X+vec[2].X) + vec[3].X),
-		Y: FRAC * (vec[0].Y + 2*(vec[1].Y+vec[2].Y) + vec[3].Y),
+// weightedSum returns the change over dt of particle i given derivatives of
+// stages weighted by b.
+func weightedSum(dt float64, b []float64, derivs [][]vect.V, i int) vect.V {
+	sum := vect.V{}
+	for k, w := range b {
+		if w != 0 {
+			sum = sum.Add(derivs[k][i].Mul(w))
+		}
 	}
+	return sum.Mul(dt)
 }
@@ -1,7 +1,12 @@
 package rk4
 
 import (
+	"fmt"
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/internal/kepler"
+	"github.com/niksaak/goticles/units"
 	"github.com/niksaak/goticles/vect"
+	"math"
 	"math/rand"
 	"testing"
 )
@@ -18,12 +23,12 @@ func TestOneBodyPositionChange(t *testing.T) {
 	if count := len(space.Particles); count != 1 {
 		t.Errorf("particle count is not 1 but %d", count)
 	}
-	p.Position = vect.V{0, 0}
-	p.Velocity = vect.V{1, 1}
-	t.Logf("%.4f: %v", space.Time, p)
+	p.P().Position = vect.V{0, 0}
+	p.P().Velocity = vect.V{1, 1}
+	t.Logf("%.4f: %v", space.Time(), p.P())
 	for c := 0.0; c < 1; c += STEP {
 		space.Step(STEP)
-		t.Logf("%.4f: %v", space.Time, p)
+		t.Logf("%.4f: %v", space.Time(), p.P())
 	}
 }
 
@@ -32,16 +37,171 @@ func TestTwoBodyPositionChanges(t *testing.T) {
 	const MASS = 10000
 	space := New()
 	p1 := space.MkParticle(MASS)
-	p1.Position = vect.V{0, 0}
+	p1.P().Position = vect.V{0, 0}
 	p2 := space.MkParticle(MASS)
-	p2.Position = vect.V{0.5, 0.5}
+	p2.P().Position = vect.V{0.5, 0.5}
 	t.Log("Before:")
-	t.Log(p1)
-	t.Log(p2)
+	t.Log(p1.P())
+	t.Log(p2.P())
 	space.Step(STEP)
 	t.Log("After:")
-	t.Log(p1)
-	t.Log(p2)
+	t.Log(p1.P())
+	t.Log(p2.P())
+}
+
+func TestGravitationalConstant(t *testing.T) {
+	const STEP = 1.0 / 10
+	for _, g := range []float64{0, 1} {
+		space := New()
+		space.G = g
+		space.MkParticle(1).P().Position = vect.V{-0.5, 0}
+		space.MkParticle(1).P().Position = vect.V{0.5, 0}
+		space.Step(STEP)
+		dist := space.Particle(0).Position.Dst(space.Particle(1).Position)
+		if g == 0 && dist != 1 {
+			t.Errorf("particles moved without gravity: distance %v", dist)
+		}
+		if g != 0 && dist >= 1 {
+			t.Errorf("particles did not attract with G = %v", g)
+		}
+	}
+}
+
+func TestMomentumConservation(t *testing.T) {
+	const STEP = 1.0 / 100
+	space := New()
+	space.G = 1
+	p1 := space.MkParticle(1)
+	p1.P().Position = vect.V{-0.5, 0}
+	p1.P().Velocity = vect.V{0, 2}
+	p2 := space.MkParticle(4)
+	p2.P().Position = vect.V{0.5, 0}
+	p2.P().Velocity = vect.V{0, -0.5}
+	for i := 0; i < 100; i++ {
+		space.Step(STEP)
+	}
+	momentum := p1.P().Velocity.Mul(p1.P().Mass).Add(
+		p2.P().Velocity.Mul(p2.P().Mass))
+	if momentum.Len() > 1e-9 {
+		t.Errorf("momentum is not conserved: %v", momentum)
+	}
+}
+
+func TestForceLaws(t *testing.T) {
+	const STEP = 1.0 / 1000
+	const RADIUS = 2
+	laws := []struct {
+		law      goticles.ForceLaw
+		exponent float64
+		speed    float64 // of circular orbit around unit mass, with G = 1
+	}{
+		{goticles.Newtonian, 0, math.Sqrt(1.0 / RADIUS)},
+		{goticles.Logarithmic, 0, 1},
+		{goticles.PowerLaw, 3, 1.0 / RADIUS},
+	}
+	for _, l := range laws {
+		space := New()
+		space.G = 1
+		space.Law = l.law
+		space.Exponent = l.exponent
+		space.MkParticle(1)
+		p := space.MkParticle(1e-12)
+		p.P().Position = vect.V{RADIUS, 0}
+		p.P().Velocity = vect.V{0, l.speed}
+		for i := 0; i < 1000; i++ {
+			space.Step(STEP)
+		}
+		if r := p.P().Position.Len(); math.Abs(r-RADIUS) > 1e-6 {
+			t.Errorf("%v: orbit radius is not %v but %v", l.law, RADIUS, r)
+		}
+	}
+}
+
+func TestSetUnits(t *testing.T) {
+	space := New()
+	if u := space.Units(); u != units.SI {
+		t.Errorf("new space is not in SI but %v", u)
+	}
+	space.MkParticle(units.SolarMass).P().Position = vect.V{units.AU, 0}
+	space.SetUnits(units.Astronomical)
+	if u := space.Units(); u != units.Astronomical {
+		t.Errorf("space is not in astronomical units but %v", u)
+	}
+	p := space.Particle(0)
+	if math.Abs(p.Mass-1) > 1e-12 || math.Abs(p.Position.X-1) > 1e-12 {
+		t.Errorf("particle was not converted: %v", p)
+	}
+	if math.Abs(space.G-units.Astronomical.G()) > 1e-12 {
+		t.Errorf("G is not %v but %v", units.Astronomical.G(), space.G)
+	}
+}
+
+func TestRmParticle(t *testing.T) {
+	const COUNT = 4
+	const STEP = 1.0 / 1000
+	space := New()
+	space.SetUnits(units.NBody(1, 1))
+	for i := 0; i < COUNT; i++ {
+		p := space.MkParticle(float64(i + 1)).P()
+		p.Position = vect.V{float64(i) / COUNT, float64(i % 2)}
+	}
+	space.Step(STEP)
+	space.RmParticle(1)
+	before := append([]goticles.P(nil), space.All()...)
+	space.Step(STEP)
+	for i, id := range []int{0, 3, 2} {
+		p := space.Particle(id)
+		if p == nil {
+			t.Fatalf("particle %d is missing", id)
+		}
+		// over a short step, the particle moves with the gravity of those left
+		q := before[i]
+		want := q.Position.Add(q.Velocity.Mul(STEP)).Add(
+			space.Accel(before, i).Mul(STEP * STEP / 2))
+		if p.Id != id || p.Mass != float64(id+1) ||
+			p.Position.Dst(want) > 1e-8 {
+			t.Errorf("particle %d is %v, not at %v", id, *p, want)
+		}
+	}
+}
+
+// randomSpace returns a Space in N-body units with count particles of total
+// mass 1, placed reproducibly.
+func randomSpace(count int) *Space {
+	rnd := rand.New(rand.NewSource(1))
+	space := New()
+	space.SetUnits(units.NBody(1, 1))
+	for i := 0; i < count; i++ {
+		p := space.MkParticle(1.0 / float64(count)).P()
+		p.Position = vect.V{rnd.Float64() - 0.5, rnd.Float64() - 0.5}
+		p.Velocity = vect.V{rnd.Float64() - 0.5, rnd.Float64() - 0.5}
+	}
+	return space
+}
+
+func TestWorkers(t *testing.T) {
+	const COUNT = 100
+	const STEP = 1.0 / 100
+	reference := randomSpace(COUNT)
+	reference.Workers = 1
+	for i := 0; i < 10; i++ {
+		reference.Step(STEP)
+	}
+	for _, workers := range []int{2, 3, 8} {
+		space := randomSpace(COUNT)
+		space.Workers = workers
+		for i := 0; i < 10; i++ {
+			space.Step(STEP)
+		}
+		for i, p := range space.Particles {
+			q := reference.Particles[i]
+			if !p.Position.Eql(q.Position) || !p.Velocity.Eql(q.Velocity) {
+				t.Errorf("%d workers: particle %d is %v, not %v",
+					workers, i, p, q)
+				break
+			}
+		}
+	}
 }
 
 func BenchmarkSpace1(b *testing.B) {
@@ -49,12 +209,12 @@ func BenchmarkSpace1(b *testing.B) {
 	const MASS = 10000
 	space := New()
 	particle := space.MkParticle(MASS)
-	particle.Velocity = vect.V{1, 0}
+	particle.P().Velocity = vect.V{1, 0}
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
 		space.Step(STEP)
 	}
-	b.Logf("t: %.4f; p: %v", space.Time, particle)
+	b.Logf("t: %.4f; p: %v", space.Time(), particle.P())
 }
 
 func BenchmarkSpace512(b *testing.B) {
@@ -63,7 +223,7 @@ func BenchmarkSpace512(b *testing.B) {
 	const STEP = 1.0 / 60
 	space := New()
 	for i := 0; i < PARTICLE_COUNT; i++ {
-		particle := space.MkParticle(MASS)
+		particle := space.MkParticle(MASS).P()
 		particle.Velocity = vect.V{rf64(), rf64()}
 	}
 	particle := &space.Particles[0]
@@ -71,7 +231,7 @@ func BenchmarkSpace512(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		space.Step(STEP)
 	}
-	b.Logf("t: %.4f; p: %v", space.Time, particle)
+	b.Logf("t: %.4f; p: %v", space.Time(), particle)
 }
 
 func BenchmarkSpace1024(b *testing.B) {
@@ -80,7 +240,7 @@ func BenchmarkSpace1024(b *testing.B) {
 	const MASS = 10000
 	space := New()
 	for i := 0; i < PARTICLE_COUNT; i++ {
-		particle := space.MkParticle(MASS)
+		particle := space.MkParticle(MASS).P()
 		particle.Velocity = vect.V{rf64(), rf64()}
 	}
 	particle := &space.Particles[0]
@@ -88,5 +248,176 @@ func BenchmarkSpace1024(b *testing.B) {
 	for i := 0; i < b.N; i++ {
 		space.Step(STEP)
 	}
-	b.Logf("t: %.4f; p: %v", space.Time, particle)
+	b.Logf("t: %.4f; p: %v", space.Time(), particle)
+}
+
+func BenchmarkWorkers1024(b *testing.B) {
+	const STEP = 1.0 / 60
+	for _, workers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprint(workers), func(b *testing.B) {
+			space := randomSpace(1024)
+			space.Workers = workers
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				space.Step(STEP)
+			}
+		})
+	}
+}
+
+func TestTableaux(t *testing.T) {
+	const EPS = 1e-14
+	for m := range tableaux {
+		tab := &tableaux[m]
+		if len(tab.b) > len(tab.a) || len(tab.bHat) > len(tab.a) {
+			t.Errorf("%v: tableau of %d stages has %d and %d weights",
+				Method(m), len(tab.a), len(tab.b), len(tab.bHat))
+			continue
+		}
+		// nodes, the times into the step at which stages are evaluated
+		c := make([]float64, len(tab.a))
+		for k, row := range tab.a {
+			if len(row) != k {
+				t.Errorf("%v: stage %d is %v", Method(m), k, row)
+			}
+			for _, w := range row {
+				c[k] += w
+			}
+		}
+		for _, sol := range []struct {
+			b     []float64
+			order int
+		}{{tab.b, tab.order}, {tab.bHat, tab.embedded}} {
+			sum, moment := 0.0, 0.0
+			for k, w := range sol.b {
+				sum += w
+				moment += w * c[k]
+			}
+			if sol.b != nil && math.Abs(sum-1) > EPS {
+				t.Errorf("%v: weights %v sum to %v", Method(m), sol.b, sum)
+			}
+			// the condition of second order
+			if sol.order >= 2 && math.Abs(moment-0.5) > EPS {
+				t.Errorf("%v: weights %v have moment %v, not 1/2",
+					Method(m), sol.b, moment)
+			}
+		}
+	}
+}
+
+// binary returns a space of method holding kepler.Binary.
+func binary(method Method) *Space {
+	space := New()
+	space.Method = method
+	space.G, space.Softening = 1, 0
+	kepler.Binary(space)
+	return space
+}
+
+func TestMethodOrder(t *testing.T) {
+	for _, c := range []struct {
+		method Method
+		steps  int
+	}{
+		{RK4, 200}, {ThreeEighths, 200}, {Heun, 2000}, {RK3, 500},
+		{Fehlberg, 200}, {DormandPrince, 800},
+	} {
+		order := float64(tableaux[c.method].order)
+		coarse := kepler.OrbitError(binary(c.method), c.steps)
+		fine := kepler.OrbitError(binary(c.method), 2*c.steps)
+		observed := math.Log2(coarse / fine)
+		t.Logf("%v: errors %.3g and %.3g, order %.2f",
+			c.method, coarse, fine, observed)
+		if math.Abs(observed-order) > 0.5 {
+			t.Errorf("%v: order is %.2f, not %v", c.method, observed, order)
+		}
+	}
+}
+
+func TestTolerance(t *testing.T) {
+	const STEPS = 10
+	for _, c := range []struct {
+		method     Method
+		tolerances []float64
+	}{
+		{Heun, []float64{1e-2, 1e-3}},
+		{Fehlberg, []float64{1e-4, 1e-6, 1e-8}},
+		{DormandPrince, []float64{1e-4, 1e-6, 1e-8}},
+	} {
+		method := c.method
+		prevErr, prevSubsteps := math.Inf(1), 0
+		for _, tolerance := range c.tolerances {
+			space := binary(method)
+			space.Tolerance = tolerance
+			start := space.Particles[0].Position
+			substeps := 0
+			for i := 0; i < STEPS; i++ {
+				space.Step(kepler.Period / STEPS)
+				substeps += space.Substeps()
+			}
+			err := space.Particles[0].Position.Dst(start)
+			t.Logf("%v: tolerance %v, error %.3g in %d substeps",
+				method, tolerance, err, substeps)
+			if math.Abs(space.Time()-kepler.Period) > 1e-12 {
+				t.Errorf("%v: time is %v, not %v",
+					method, space.Time(), kepler.Period)
+			}
+			if err >= prevErr || substeps <= prevSubsteps ||
+				err > 1e3*tolerance {
+				t.Errorf("%v: tolerance %v gives error %v in %d substeps",
+					method, tolerance, err, substeps)
+			}
+			prevErr, prevSubsteps = err, substeps
+		}
+	}
+	defer func() {
+		if recover() == nil {
+			t.Errorf("adaptive step without error estimate did not panic")
+		}
+	}()
+	space := binary(RK4)
+	space.Tolerance = 1e-6
+	space.Step(kepler.Period)
+}
+
+func TestToleranceCutoff(t *testing.T) {
+	const STEP = 0.1
+	// the pair crosses the cutoff of the default kernel head-on, where the
+	// force jumps and shrinking the substep doesn't shrink the error
+	space := New()
+	space.G = 1
+	space.Softening = 0.1
+	space.Method = Fehlberg
+	space.Tolerance = 1e-6
+	for _, x := range []float64{-0.2, 0.2} {
+		p := space.MkParticle(1).P()
+		p.Position = vect.V{x, 0}
+		p.Velocity = vect.V{-5 * x, 0}
+	}
+	for i := 0; i < 5; i++ {
+		space.Step(STEP)
+		if n := space.Substeps(); n > 1/MIN_SUBSTEP {
+			t.Errorf("step %d took %d substeps", i, n)
+		}
+	}
+	if math.Abs(space.Time()-5*STEP) > 1e-12 {
+		t.Errorf("time is %v, not %v", space.Time(), 5*STEP)
+	}
+}
+
+func TestToleranceEquilibrium(t *testing.T) {
+	const STEPS = 10
+	// the massless particle barely moves from between the pair, so that
+	// its changes alone can't be told from the rounding of opposite pulls
+	space := binary(DormandPrince)
+	space.Tolerance = 1e-6
+	space.MkParticle(0).P().Position = vect.V{1e-12, 0}
+	substeps := 0
+	for i := 0; i < STEPS; i++ {
+		space.Step(kepler.Period / STEPS)
+		substeps += space.Substeps()
+	}
+	if substeps > 1000 {
+		t.Errorf("orbit took %d substeps", substeps)
+	}
 }
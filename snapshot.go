@@ -0,0 +1,33 @@
+package goticles
+
+// The Snapshot type records the gravity and particles of a Space, so that a
+// Space caching forces between steps can tell whether anything they depend on
+// was changed in between, by hand through Particle and handles, or by
+// MkParticle, RmParticle and changes of gravity or units.
+type Snapshot struct {
+	gravity   Gravity
+	particles []P
+}
+
+// Take records g and the Ids, masses, positions and velocities of particles.
+func (s *Snapshot) Take(g *Gravity, particles []P) {
+	s.gravity = *g
+	s.particles = append(s.particles[:0], particles...)
+}
+
+// Holds reports whether g and particles are as they were when the snapshot
+// was last taken. A Snapshot never taken holds nothing but an empty Space of
+// zero gravity.
+func (s *Snapshot) Holds(g *Gravity, particles []P) bool {
+	if *g != s.gravity || len(particles) != len(s.particles) {
+		return false
+	}
+	for i := range particles {
+		p, q := &particles[i], &s.particles[i]
+		if p.Id != q.Id || p.Mass != q.Mass ||
+			!p.Position.Eql(q.Position) || !p.Velocity.Eql(q.Velocity) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,38 @@
+package goticles
+
+import (
+	"github.com/niksaak/goticles/vect"
+	"testing"
+)
+
+func TestSnapshot(t *testing.T) {
+	var x Index
+	g := NewGravity()
+	for i := 0; i < 3; i++ {
+		x.MkParticle(1).P().Position = vect.V{float64(i), 0}
+	}
+	var s Snapshot
+	if s.Holds(&g, x.Particles) {
+		t.Errorf("snapshot holds particles before being taken")
+	}
+	for _, change := range []struct {
+		name string
+		do   func()
+	}{
+		{"move", func() { x.Particle(1).Position.Y = 1 }},
+		{"push", func() { x.Particle(2).Velocity.X = 1 }},
+		{"weigh", func() { x.Particle(0).Mass = 2 }},
+		{"soften", func() { g.Softening /= 2 }},
+		{"remove and make", func() { x.RmParticle(0); x.MkParticle(2) }},
+	} {
+		s.Take(&g, x.Particles)
+		if !s.Holds(&g, x.Particles) {
+			t.Fatalf("%s: snapshot doesn't hold particles just taken",
+				change.name)
+		}
+		change.do()
+		if s.Holds(&g, x.Particles) {
+			t.Errorf("%s: snapshot holds changed particles", change.name)
+		}
+	}
+}
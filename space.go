@@ -0,0 +1,24 @@
+package goticles
+
+// Space is the interface implemented by the particle simulation backends,
+// so that they can be used interchangeably.
+type Space interface {
+	// Particle returns the particle with given id, or nil if there is none.
+	// The pointer is only valid until the next call to MkParticle or
+	// RmParticle; use a Handle to refer to a particle for longer.
+	Particle(id int) *P
+	// MkParticle creates a new particle of given mass and returns a handle
+	// to it.
+	MkParticle(mass float64) Handle
+	// RmParticle removes the particle with given id from the Space.
+	RmParticle(id int)
+	// Step advances the simulation by dt.
+	Step(dt float64)
+	// Time returns the current simulation time.
+	Time() float64
+	// Len returns the number of particles in the Space.
+	Len() int
+	// All returns all particles of the Space, in no particular order. The
+	// slice is only valid until the next call to MkParticle or RmParticle.
+	All() []P
+}
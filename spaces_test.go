@@ -0,0 +1,116 @@
+package goticles_test
+
+import (
+	"github.com/niksaak/goticles/bnticles"
+	"github.com/niksaak/goticles/hermite"
+	"github.com/niksaak/goticles/leapfrog"
+	"github.com/niksaak/goticles/rk4"
+	"github.com/niksaak/goticles/symplectic"
+	"github.com/niksaak/goticles/units"
+	"github.com/niksaak/goticles/vect"
+	"math"
+	"testing"
+)
+
+// spaces makes a new Space of every backend and scheme that runs on the CPU.
+var spaces = []struct {
+	name string
+	new  func() units.Space
+}{
+	{"rk4", func() units.Space { return rk4.New() }},
+	{"leapfrog KDK", func() units.Space {
+		s := leapfrog.New()
+		s.Scheme = leapfrog.KDK
+		return s
+	}},
+	{"leapfrog DKD", func() units.Space {
+		s := leapfrog.New()
+		s.Scheme = leapfrog.DKD
+		return s
+	}},
+	{"leapfrog Block", func() units.Space {
+		s := leapfrog.New()
+		s.Scheme = leapfrog.Block
+		return s
+	}},
+	{"symplectic Yoshida4", func() units.Space {
+		s := symplectic.New()
+		s.Scheme = symplectic.Yoshida4
+		return s
+	}},
+	{"symplectic Yoshida6", func() units.Space {
+		s := symplectic.New()
+		s.Scheme = symplectic.Yoshida6
+		return s
+	}},
+	{"symplectic ForestRuth", func() units.Space {
+		s := symplectic.New()
+		s.Scheme = symplectic.ForestRuth
+		return s
+	}},
+	{"bnticles RK4", func() units.Space {
+		s := bnticles.New()
+		s.Method = bnticles.RK4
+		return s
+	}},
+	{"bnticles Leapfrog", func() units.Space {
+		s := bnticles.New()
+		s.Method = bnticles.Leapfrog
+		return s
+	}},
+	{"hermite", func() units.Space { return hermite.New() }},
+}
+
+func TestRmParticle(t *testing.T) {
+	// gravity cached with the removed particle mustn't outlive it
+	for _, c := range spaces {
+		space := c.new()
+		space.SetUnits(units.NBody(1, 1))
+		for _, x := range []float64{-0.5, 0.5} {
+			space.MkParticle(1).P().Position = vect.V{x, 0}
+		}
+		space.Step(1.0 / 60)
+		space.RmParticle(0)
+		space.MkParticle(0) // massless, keeping the count
+		v := space.Particle(1).Velocity
+		space.Step(1.0 / 60)
+		if p := space.Particle(1); !p.Velocity.Eql(v) {
+			t.Errorf("%s: lone particle sped from %v to %v",
+				c.name, v, p.Velocity)
+		}
+	}
+}
+
+func TestForceChange(t *testing.T) {
+	for _, c := range spaces {
+		space := c.new()
+		p := space.MkParticle(1)
+		space.Step(1)
+		p.P().Force = vect.V{1, 0}
+		space.Step(1)
+		if v := p.P().Velocity; math.Abs(v.X-1) > 1e-9 || v.Y != 0 {
+			t.Errorf("%s: velocity is not {1 0} but %v", c.name, v)
+		}
+	}
+}
+
+func TestMovedParticle(t *testing.T) {
+	// gravity cached before a particle was moved by hand mustn't outlive it
+	for _, c := range spaces {
+		space := c.new()
+		space.SetUnits(units.NBody(1, 1))
+		for _, x := range []float64{-0.5, 0.5} {
+			space.MkParticle(1).P().Position = vect.V{x, 0}
+		}
+		space.Step(1.0 / 60)
+		// move the first particle to the other side of the second one
+		other := space.Particle(1)
+		space.Particle(0).Position = other.Position.Add(vect.V{1, 0})
+		v := other.Velocity
+		space.Step(1.0 / 60)
+		if dv := space.Particle(1).Velocity.Sub(v); dv.X <= 0 {
+			t.Errorf("%s: particle was pulled by %v, away from the other",
+				c.name, dv)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+package goticles
+
+import (
+	"math"
+)
+
+// Substep returns the next substep to take of the time left, at most max in
+// magnitude. Substeps are made equal until the end, so that the last one
+// isn't tiny.
+func Substep(left, max float64) float64 {
+	if math.Abs(max) >= math.Abs(left) {
+		return left
+	}
+	return left / math.Ceil(math.Abs(left/max))
+}
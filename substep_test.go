@@ -0,0 +1,20 @@
+package goticles
+
+import (
+	"testing"
+)
+
+func TestSubstep(t *testing.T) {
+	for _, c := range []struct{ left, max, h float64 }{
+		{1, 2, 1},
+		{1, 0.3, 0.25},
+		{-1, 0.3, -0.25},
+		{-1, -0.5, -0.5},
+		{1, 0.5, 0.5},
+	} {
+		if h := Substep(c.left, c.max); h != c.h {
+			t.Errorf("substep of %v at most %v is %v, not %v",
+				c.left, c.max, h, c.h)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+// Package symplectic integrates particles with composition schemes of higher
+// order than leapfrog, which keep energy error bounded on long runs.
+package symplectic
+
+import (
+	"fmt"
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/units"
+	"github.com/niksaak/goticles/vect"
+	"math"
+)
+
+// The Scheme type selects the composition of kicks and drifts making a step.
+type Scheme int
+
+const (
+	// Yoshida4 is the fourth order triple jump of Yoshida, composing three
+	// kick-drift-kick leapfrog steps. It evaluates gravity three times per
+	// step, reusing that computed at the end of the previous step.
+	Yoshida4 Scheme = iota
+	// Yoshida6 is the sixth order scheme of Yoshida (solution A), composing
+	// seven kick-drift-kick leapfrog steps.
+	Yoshida6
+	// ForestRuth is the fourth order scheme of Forest & Ruth. It is the
+	// triple jump of drift-kick-drift leapfrog steps, evaluating forces
+	// three times per step.
+	ForestRuth
+)
+
+func (s Scheme) String() string {
+	switch s {
+	case Yoshida4:
+		return "Yoshida4"
+	case Yoshida6:
+		return "Yoshida6"
+	case ForestRuth:
+		return "ForestRuth"
+	default:
+		return fmt.Sprintf("Scheme(%d)", int(s))
+	}
+}
+
+// The coefficients type holds a step as alternating kicks and drifts, in
+// fractions of the step. Each kick[i] precedes drift[i], and the last kick
+// follows the last drift.
+type coefficients struct {
+	kick  []float64
+	drift []float64
+}
+
+// kdk returns coefficients composing kick-drift-kick leapfrog steps of
+// weights, merging adjacent kicks.
+func kdk(weights ...float64) coefficients {
+	c := coefficients{
+		kick:  make([]float64, len(weights)+1),
+		drift: weights,
+	}
+	for i, w := range weights {
+		c.kick[i] += w / 2
+		c.kick[i+1] += w / 2
+	}
+	return c
+}
+
+// dkd returns coefficients composing drift-kick-drift leapfrog steps of
+// weights, merging adjacent drifts.
+func dkd(weights ...float64) coefficients {
+	c := coefficients{
+		kick:  make([]float64, len(weights)+2),
+		drift: make([]float64, len(weights)+1),
+	}
+	for i, w := range weights {
+		c.drift[i] += w / 2
+		c.kick[i+1] = w
+		c.drift[i+1] += w / 2
+	}
+	return c
+}
+
+// tripleJump returns weights of the fourth order composition of a second
+// order step.
+func tripleJump() []float64 {
+	cbrt := math.Cbrt(2)
+	w1 := 1 / (2 - cbrt)
+	return []float64{w1, -cbrt * w1, w1}
+}
+
+// yoshida6 returns weights of the sixth order composition of Yoshida.
+func yoshida6() []float64 {
+	const (
+		W1 = -1.17767998417887
+		W2 = 0.235573213359357
+		W3 = 0.784513610477560
+		W0 = 1 - 2*(W1+W2+W3)
+	)
+	return []float64{W3, W2, W1, W0, W1, W2, W3}
+}
+
+var schemes = [...]coefficients{
+	Yoshida4:   kdk(tripleJump()...),
+	Yoshida6:   kdk(yoshida6()...),
+	ForestRuth: dkd(tripleJump()...),
+}
+
+type Space struct {
+	units.Base
+	Scheme Scheme
+	// Eta is the fraction of the timescale of acceleration change, |a|/|ȧ|,
+	// that a particle may move in a substep when positive, making Step split
+	// its time into substeps no longer than that for any particle. When it is
+	// zero, each Step is taken at once.
+	Eta         float64
+	Workers     int // goroutines computing forces, see goticles.Workers
+	gravities   []vect.V
+	jerks       []vect.V // rates of change of gravity, when Eta is positive
+	fieldAccel  []vect.V
+	accelerated bool // whether gravities are up to date
+	jerked      bool // whether jerks were computed with them
+	substeps    int
+	snapshot    goticles.Snapshot // particles at the end of the last step
+}
+
+var _ units.Space = &Space{}
+
+func New() *Space {
+	return &Space{Base: units.NewBase()}
+}
+
+// Substeps returns the number of substeps taken by the last Step.
+func (s *Space) Substeps() int {
+	return s.substeps
+}
+
+// accelerate computes the gravity of every particle, storing it in
+// s.gravities, and its jerk in s.jerks if s.Eta is positive.
+func (s *Space) accelerate() {
+	ln := len(s.Particles)
+	if len(s.gravities) != ln {
+		s.gravities = make([]vect.V, ln)
+		s.fieldAccel = make([]vect.V, ln)
+		s.jerks = make([]vect.V, ln)
+	}
+	goticles.Parallel(s.Workers, ln, func(lo, hi int) {
+		for i := lo; i < hi; i++ {
+			if s.Eta > 0 {
+				s.gravities[i], s.jerks[i] = s.AccelJerk(s.Particles, i)
+			} else {
+				s.gravities[i], s.jerks[i] = s.Accel(s.Particles, i), vect.V{}
+			}
+		}
+	})
+	s.jerked = s.Eta > 0
+	s.accelerated = true
+}
+
+// kick advances velocities by dt with the total acceleration, which it
+// stores in the particles' Acceleration. Gravity is computed first unless it
+// is up to date, while external forces and fields, which may have changed,
+// always are.
+func (s *Space) kick(dt float64) {
+	if dt == 0 {
+		return
+	}
+	if !s.accelerated {
+		s.accelerate()
+	}
+	for i := range s.Particles {
+		s.fieldAccel[i] = vect.V{}
+	}
+	s.Fields.Accelerate(s.Particles, s.fieldAccel)
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Acceleration = s.gravities[i].Add(
+			p.ExternalAcceleration()).Add(s.fieldAccel[i])
+		p.Velocity = p.Velocity.Add(p.Acceleration.Mul(dt))
+	}
+}
+
+// drift advances positions by dt.
+func (s *Space) drift(dt float64) {
+	if dt == 0 {
+		return
+	}
+	for i := range s.Particles {
+		p := &s.Particles[i]
+		p.Position = p.Position.Add(p.Velocity.Mul(dt))
+	}
+	s.accelerated = false
+}
+
+// compose advances the simulation by dt with the kicks and drifts of c.
+func (s *Space) compose(dt float64, c coefficients) {
+	for i, d := range c.drift {
+		s.kick(c.kick[i] * dt)
+		s.drift(d * dt)
+	}
+	s.kick(c.kick[len(c.drift)] * dt)
+}
+
+// timestep returns the smallest substep allowed by s.Eta for any particle,
+// or +Inf if none constrains it.
+func (s *Space) timestep() float64 {
+	if !s.accelerated || !s.jerked {
+		s.accelerate()
+	}
+	dt := math.Inf(1)
+	for i := range s.Particles {
+		t := s.Eta * s.gravities[i].Len() / s.jerks[i].Len()
+		if t > 0 && t < dt {
+			dt = t
+		}
+	}
+	return dt
+}
+
+// Step advances the simulation by dt with s.Scheme, in substeps when s.Eta
+// is positive. Gravity computed at its end is reused by the next step if
+// particles and gravity are left as they are; external forces and fields are
+// applied afresh at every kick.
+func (s *Space) Step(dt float64) {
+	if s.Scheme < 0 || int(s.Scheme) >= len(schemes) {
+		panic(fmt.Errorf("Step: bad scheme - %v", s.Scheme))
+	}
+	if !s.snapshot.Holds(&s.Gravity, s.Particles) {
+		s.accelerated = false
+	}
+	s.substeps = 0
+	for left := dt; ; {
+		h := left
+		if s.Eta > 0 {
+			h = goticles.Substep(left, s.timestep())
+		}
+		s.compose(h, schemes[s.Scheme])
+		s.substeps++
+		if h == left {
+			break
+		}
+		left -= h
+	}
+	s.snapshot.Take(&s.Gravity, s.Particles)
+	s.Advance(dt)
+}
@@ -0,0 +1,115 @@
+package symplectic
+
+import (
+	"github.com/niksaak/goticles/diagnostics"
+	"github.com/niksaak/goticles/internal/kepler"
+	"github.com/niksaak/goticles/units"
+	"math"
+	"testing"
+)
+
+// binary returns a space of scheme holding kepler.Binary.
+func binary(scheme Scheme) *Space {
+	space := New()
+	space.Scheme = scheme
+	space.G, space.Softening = 1, 0
+	kepler.Binary(space)
+	return space
+}
+
+func TestOrder(t *testing.T) {
+	for _, c := range []struct {
+		scheme Scheme
+		order  float64
+		steps  int
+	}{
+		{Yoshida4, 4, 100}, {Yoshida6, 6, 50}, {ForestRuth, 4, 100},
+	} {
+		coarse := kepler.OrbitError(binary(c.scheme), c.steps)
+		fine := kepler.OrbitError(binary(c.scheme), 2*c.steps)
+		order := math.Log2(coarse / fine)
+		t.Logf("%v: errors %.3g and %.3g, order %.2f",
+			c.scheme, coarse, fine, order)
+		if math.Abs(order-c.order) > 0.5 {
+			t.Errorf("%v: order is %.2f, not %v", c.scheme, order, c.order)
+		}
+	}
+}
+
+func TestEnergyBounded(t *testing.T) {
+	const ORBITS = 200
+	const STEPS = 100
+	for _, scheme := range []Scheme{Yoshida4, Yoshida6, ForestRuth} {
+		space := binary(scheme)
+		r0 := diagnostics.MeasureSpace(space)
+		var early, late float64
+		for i := 0; i < ORBITS*STEPS; i++ {
+			space.Step(kepler.Period / STEPS)
+			drift := diagnostics.MeasureSpace(space).Drift(r0)
+			if i < ORBITS*STEPS/10 {
+				early = math.Max(early, drift)
+			} else if i >= ORBITS*STEPS*9/10 {
+				late = math.Max(late, drift)
+			}
+		}
+		t.Logf("%v: energy drift %.3g early, %.3g late", scheme, early, late)
+		if late > 2*early || late > 1e-3 {
+			t.Errorf("%v: energy drift grew from %v to %v",
+				scheme, early, late)
+		}
+	}
+}
+
+func TestEta(t *testing.T) {
+	const STEPS = 10
+	for _, scheme := range []Scheme{Yoshida4, Yoshida6, ForestRuth} {
+		fixed, adaptive := binary(scheme), binary(scheme)
+		adaptive.Eta = 0.05
+		r0 := diagnostics.MeasureSpace(fixed)
+		substeps := 0
+		for i := 0; i < STEPS; i++ {
+			fixed.Step(kepler.Period / STEPS)
+			adaptive.Step(kepler.Period / STEPS)
+			substeps += adaptive.Substeps()
+		}
+		if adaptive.Time() != fixed.Time() || fixed.Substeps() != 1 {
+			t.Errorf("%v: time is %v in %d substeps, not %v in one",
+				scheme, adaptive.Time(), fixed.Substeps(), fixed.Time())
+		}
+		fixedDrift := diagnostics.MeasureSpace(fixed).Drift(r0)
+		adaptiveDrift := diagnostics.MeasureSpace(adaptive).Drift(r0)
+		t.Logf("%v: energy drift %.3g fixed, %.3g in %d substeps",
+			scheme, fixedDrift, adaptiveDrift, substeps)
+		if substeps <= STEPS || adaptiveDrift > fixedDrift/100 {
+			t.Errorf("%v: adaptive drift %v in %d substeps, fixed %v",
+				scheme, adaptiveDrift, substeps, fixedDrift)
+		}
+	}
+}
+
+func TestSetUnits(t *testing.T) {
+	// gravity and jerks cached in old units mustn't survive the switch
+	space := New()
+	space.Eta = 0.05
+	space.SetUnits(units.NBody(1, 1))
+	space.G, space.Softening = 1, 0
+	kepler.Binary(space)
+	space.Step(kepler.Period / 10)
+	space.SetUnits(units.NBody(2, 1))
+	reference := New()
+	reference.Eta = space.Eta
+	reference.SetUnits(space.Units())
+	reference.Softening = 0
+	for _, p := range space.All() {
+		q := reference.MkParticle(p.Mass).P()
+		q.Position, q.Velocity = p.Position, p.Velocity
+	}
+	space.Step(kepler.Period / 10)
+	reference.Step(kepler.Period / 10)
+	for id := 0; id < 2; id++ {
+		p, q := space.Particle(id), reference.Particle(id)
+		if !p.Position.Eql(q.Position) || !p.Velocity.Eql(q.Velocity) {
+			t.Errorf("particle %d is %v, not %v", id, *p, *q)
+		}
+	}
+}
@@ -0,0 +1,34 @@
+package units
+
+import (
+	"github.com/niksaak/goticles"
+)
+
+// The Base type is a goticles.Base measured in a unit system. Embedded in a
+// Space in place of goticles.Base, it makes it a units.Space.
+type Base struct {
+	goticles.Base
+	units System
+}
+
+// NewBase returns a Base with default gravity, in SI units.
+func NewBase() Base {
+	return Base{Base: goticles.NewBase(), units: SI}
+}
+
+// Units returns the unit system of the Space.
+func (b *Base) Units() System {
+	return b.units
+}
+
+// SetUnits switches the Space to unit system u, converting its particles,
+// time, softening length and the fields implementing goticles.Scaler, and
+// setting G to its value in u. Other fields are left as they are.
+func (b *Base) SetUnits(u System) {
+	Convert(b.Particles, b.units, u)
+	ConvertFields(b.Fields, b.units, u)
+	b.SetTime(ConvertTime(b.Time(), b.units, u))
+	b.Softening = ConvertLength(b.Softening, b.units, u)
+	b.G = u.G()
+	b.units = u
+}
@@ -0,0 +1,117 @@
+// Package units provides unit systems for particle simulations, and
+// conversions between them.
+package units
+
+import (
+	"github.com/niksaak/goticles"
+	"math"
+)
+
+// Physical constants, in SI units.
+const (
+	AU        = 1.495978707e11 // astronomical unit, m
+	Year      = 365.25 * 86400 // Julian year, s
+	SolarMass = 1.98847e30     // kg
+)
+
+// The System type describes a unit system by its units of length, mass and
+// time, each expressed in SI units.
+type System struct {
+	Name   string
+	Length float64
+	Mass   float64
+	Time   float64
+}
+
+var (
+	// SI is the International System of Units.
+	SI = System{"SI", 1, 1, 1}
+	// Astronomical measures length in AU, mass in solar masses and time in
+	// years, which makes G close to 4π².
+	Astronomical = System{"Astronomical", AU, SolarMass, Year}
+)
+
+// NBody returns the N-body unit system in which the given mass and length,
+// in SI units, are unit, and so is G.
+func NBody(mass, length float64) System {
+	return System{
+		Name:   "N-body",
+		Length: length,
+		Mass:   mass,
+		Time:   math.Sqrt(length * length * length / (goticles.G * mass)),
+	}
+}
+
+func (s System) String() string {
+	return s.Name
+}
+
+// G returns the gravitational constant in system s.
+func (s System) G() float64 {
+	return goticles.G * s.Mass * s.Time * s.Time /
+		(s.Length * s.Length * s.Length)
+}
+
+// Velocity returns the unit of velocity of system s, in SI units.
+func (s System) Velocity() float64 {
+	return s.Length / s.Time
+}
+
+// Acceleration returns the unit of acceleration of system s, in SI units.
+func (s System) Acceleration() float64 {
+	return s.Length / (s.Time * s.Time)
+}
+
+// Force returns the unit of force of system s, in SI units.
+func (s System) Force() float64 {
+	return s.Mass * s.Acceleration()
+}
+
+// ConvertLength converts length l from system from to system to.
+func ConvertLength(l float64, from, to System) float64 {
+	return l * from.Length / to.Length
+}
+
+// ConvertMass converts mass m from system from to system to.
+func ConvertMass(m float64, from, to System) float64 {
+	return m * from.Mass / to.Mass
+}
+
+// ConvertTime converts time, or a timestep, t from system from to system to.
+func ConvertTime(t float64, from, to System) float64 {
+	return t * from.Time / to.Time
+}
+
+// Convert converts particles from system from to system to, in place.
+func Convert(particles []goticles.P, from, to System) {
+	length := from.Length / to.Length
+	velocity := from.Velocity() / to.Velocity()
+	acceleration := from.Acceleration() / to.Acceleration()
+	force := from.Force() / to.Force()
+	mass := from.Mass / to.Mass
+	for i := range particles {
+		p := &particles[i]
+		p.Position = p.Position.Mul(length)
+		p.Velocity = p.Velocity.Mul(velocity)
+		p.Acceleration = p.Acceleration.Mul(acceleration)
+		p.Force = p.Force.Mul(force)
+		p.Mass *= mass
+	}
+}
+
+// ConvertFields converts parameters of fields implementing goticles.Scaler
+// from system from to system to, in place.
+func ConvertFields(fields goticles.Fields, from, to System) {
+	fields.Scale(from.Length/to.Length, from.Mass/to.Mass, from.Time/to.Time)
+}
+
+// Space is a goticles.Space aware of its unit system.
+type Space interface {
+	goticles.Space
+	// Units returns the unit system of the Space.
+	Units() System
+	// SetUnits switches the Space to another unit system, converting its
+	// particles, time, G, softening length and fields implementing
+	// goticles.Scaler.
+	SetUnits(u System)
+}
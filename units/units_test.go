@@ -0,0 +1,72 @@
+package units
+
+import (
+	"github.com/niksaak/goticles"
+	"github.com/niksaak/goticles/vect"
+	"math"
+	"testing"
+)
+
+func TestGravitationalConstant(t *testing.T) {
+	if g := SI.G(); g != goticles.G {
+		t.Errorf("G in SI is not %v but %v", goticles.G, g)
+	}
+	if g := NBody(1e30, 1e10).G(); math.Abs(g-1) > 1e-12 {
+		t.Errorf("G in N-body units is not 1 but %v", g)
+	}
+	if g := Astronomical.G(); math.Abs(g-4*math.Pi*math.Pi) > 1e-2 {
+		t.Errorf("G in astronomical units is not 4π² but %v", g)
+	}
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	particles := []goticles.P{{
+		Position: vect.V{AU, 0},
+		Velocity: vect.V{0, 29780},
+		Force:    vect.V{1, 1},
+		Mass:     5.972e24,
+	}}
+	Convert(particles, SI, Astronomical)
+	if x := particles[0].Position.X; math.Abs(x-1) > 1e-12 {
+		t.Errorf("1 AU is not 1 but %v", x)
+	}
+	// Earth's orbital velocity is about 2π AU per year
+	if v := particles[0].Velocity.Y; math.Abs(v-2*math.Pi) > 1e-2 {
+		t.Errorf("orbital velocity is not 2π but %v", v)
+	}
+	Convert(particles, Astronomical, SI)
+	if v := particles[0].Velocity.Y; math.Abs(v-29780) > 1e-6 {
+		t.Errorf("velocity did not survive round trip: %v", v)
+	}
+	if f := particles[0].Force; f.Sub(vect.V{1, 1}).Len() > 1e-12 {
+		t.Errorf("force did not survive round trip: %v", f)
+	}
+	if dt := ConvertTime(ConvertTime(1, SI, Astronomical), Astronomical, SI); math.Abs(dt-1) > 1e-12 {
+		t.Errorf("timestep did not survive round trip: %v", dt)
+	}
+}
+
+func TestConvertFields(t *testing.T) {
+	spring := &goticles.Spring{A: 0, B: 1, K: 1, Length: AU}
+	fields := goticles.Fields{
+		goticles.Uniform{0, -9.81}, goticles.Drag(1), spring,
+		goticles.ExternalField(func(p *goticles.P) vect.V { return vect.V{} }),
+	}
+	ConvertFields(fields, SI, Astronomical)
+	// accelerations are in AU per year squared
+	g := vect.V(fields[0].(goticles.Uniform)).Y
+	if want := -9.81 * Year * Year / AU; math.Abs(g/want-1) > 1e-12 {
+		t.Errorf("uniform field is not %v but %v", want, g)
+	}
+	if k, want := float64(fields[1].(goticles.Drag)),
+		Year/SolarMass; math.Abs(k/want-1) > 1e-12 {
+		t.Errorf("drag is not %v but %v", want, k)
+	}
+	if fields[2] != spring || math.Abs(spring.Length-1) > 1e-12 {
+		t.Errorf("spring was not converted in place: %v", fields[2])
+	}
+	ConvertFields(fields, Astronomical, SI)
+	if k := spring.K; math.Abs(k-1) > 1e-12 {
+		t.Errorf("spring stiffness did not survive round trip: %v", k)
+	}
+}